@@ -0,0 +1,52 @@
+package createfirebasetoken
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// blockedSubjects holds lowercase "provider:uid" entries that may neither
+// sign in nor register again.
+var blockedSubjects map[string]bool
+
+// loadBlockedSubjects reads BLOCKED_PROVIDER_SUBJECTS, a comma-separated list
+// of provider:uid entries such as github:12345.
+func loadBlockedSubjects() {
+	blockedSubjects = parseLowerSet(os.Getenv("BLOCKED_PROVIDER_SUBJECTS"))
+	if len(blockedSubjects) > 0 {
+		log.Printf("INFO: Loaded %d blocked provider subjects", len(blockedSubjects))
+	}
+}
+
+// checkBlockedSubject rejects provider identities on the denylist. It runs
+// before the user lookup so a banned identity cannot re-register after its
+// Firebase user was deleted.
+func checkBlockedSubject(profile ProviderProfile) error {
+	if !blockedSubjects[profile.Provider+":"+strings.ToLower(profile.UID)] {
+		return nil
+	}
+	log.Printf("Rejected %s user %s: provider subject is blocked.", profile.Provider, profile.UID)
+	return &requestError{
+		Status:  http.StatusForbidden,
+		Code:    "user_disabled",
+		Message: "This account has been disabled.",
+	}
+}
+
+// checkUserRecord is the post-lookup policy step that refuses to mint tokens
+// for disabled Firebase users.
+func checkUserRecord(user *auth.UserRecord) error {
+	if !user.Disabled {
+		return nil
+	}
+	log.Printf("Rejected user %s: Firebase user is disabled.", user.UID)
+	return &requestError{
+		Status:  http.StatusForbidden,
+		Code:    "user_disabled",
+		Message: "This account has been disabled.",
+	}
+}
@@ -0,0 +1,203 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// maxCustomClaimsBytes is Firebase's limit on the JSON size of developer
+// claims.
+const maxCustomClaimsBytes = 1000
+
+// reservedClaims are the names Firebase rejects as developer claims.
+var reservedClaims = map[string]bool{
+	"acr": true, "amr": true, "at_hash": true, "aud": true, "auth_time": true,
+	"azp": true, "cnf": true, "c_hash": true, "exp": true, "firebase": true,
+	"iat": true, "iss": true, "jti": true, "nbf": true, "nonce": true, "sub": true,
+}
+
+// claimMapping copies one value from the provider profile into a claim.
+type claimMapping struct {
+	Claim  string
+	Source string
+}
+
+var claimMappings []claimMapping
+
+// loadClaimMappings reads CUSTOM_CLAIMS, a comma-separated list of
+// claim=source pairs. A source is one of provider, provider_uid, email,
+// email_verified, display_name, photo_url, or userinfo.<path> to pick a value
+// out of the provider's userinfo payload by dotted path.
+func loadClaimMappings() {
+	claimMappings = nil
+	mappingsStr := strings.TrimSpace(os.Getenv("CUSTOM_CLAIMS"))
+	if mappingsStr == "" {
+		return
+	}
+	for _, pair := range strings.Split(mappingsStr, ",") {
+		claim, source, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		claim, source = strings.TrimSpace(claim), strings.TrimSpace(source)
+		if !ok || claim == "" || source == "" {
+			log.Fatalf("FATAL: CUSTOM_CLAIMS entry %q must have the form claim=source", pair)
+		}
+		if reservedClaims[claim] {
+			log.Fatalf("FATAL: CUSTOM_CLAIMS uses reserved claim name %q", claim)
+		}
+		if !validClaimSource(source) {
+			log.Fatalf("FATAL: CUSTOM_CLAIMS entry %q has unknown source %q", claim, source)
+		}
+		claimMappings = append(claimMappings, claimMapping{Claim: claim, Source: source})
+	}
+	log.Printf("INFO: Loaded custom claim mappings: %v", claimMappings)
+}
+
+func validClaimSource(source string) bool {
+	switch source {
+	case "provider", "provider_uid", "email", "email_verified", "display_name", "photo_url":
+		return true
+	}
+	return strings.HasPrefix(source, "userinfo.") && len(source) > len("userinfo.")
+}
+
+// buildCustomClaims resolves the configured claim mappings against profile
+// and merges in profile.Claims. Mappings whose source is empty or missing are
+// left out.
+func buildCustomClaims(profile ProviderProfile) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for _, mapping := range claimMappings {
+		if value, ok := claimSourceValue(profile, mapping.Source); ok {
+			claims[mapping.Claim] = value
+		}
+	}
+	for claim, value := range profile.Claims {
+		claims[claim] = value
+	}
+	return claims
+}
+
+func claimSourceValue(profile ProviderProfile, source string) (interface{}, bool) {
+	switch source {
+	case "provider":
+		return profile.Provider, true
+	case "provider_uid":
+		return profile.UID, true
+	case "email":
+		return profile.Email, profile.Email != ""
+	case "email_verified":
+		return profile.EmailVerified, profile.Email != ""
+	case "display_name":
+		return profile.DisplayName, profile.DisplayName != ""
+	case "photo_url":
+		return profile.PhotoURL, profile.PhotoURL != ""
+	}
+
+	var value interface{} = profile.UserInfo
+	for _, key := range strings.Split(strings.TrimPrefix(source, "userinfo."), ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[key]; !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// parseRolesTarget reads a token or user setting from envKey and reports
+// whether roles should be persisted as custom user claims.
+func parseRolesTarget(envKey string) bool {
+	switch target := strings.ToLower(strings.TrimSpace(os.Getenv(envKey))); target {
+	case "", "token":
+		return false
+	case "user":
+		return true
+	default:
+		log.Fatalf("FATAL: %s must be token or user, got %q", envKey, target)
+		return false
+	}
+}
+
+// setRolesClaim writes roles onto profile as the "roles" claim, either on the
+// minted token or as a persistent custom user claim.
+func setRolesClaim(profile *ProviderProfile, roles []string, persist bool) {
+	target := &profile.Claims
+	if persist {
+		target = &profile.UserClaims
+	}
+	if *target == nil {
+		*target = map[string]interface{}{}
+	}
+	(*target)["roles"] = roles
+}
+
+// addClaims adds claims to the ones minted into profile's token.
+func addClaims(profile *ProviderProfile, claims map[string]interface{}) {
+	for claim, value := range claims {
+		if profile.Claims == nil {
+			profile.Claims = map[string]interface{}{}
+		}
+		profile.Claims[claim] = value
+	}
+}
+
+// applyUserClaims merges claims into the user's persistent custom claims,
+// writing them only when something changed.
+func applyUserClaims(ctx context.Context, user *auth.UserRecord, claims map[string]interface{}) error {
+	if len(claims) == 0 {
+		return nil
+	}
+	merged := map[string]interface{}{}
+	for claim, value := range user.CustomClaims {
+		merged[claim] = value
+	}
+	for claim, value := range claims {
+		merged[claim] = value
+	}
+	if reflect.DeepEqual(normalizeClaims(merged), normalizeClaims(user.CustomClaims)) {
+		return nil
+	}
+	if err := validateCustomClaims(merged); err != nil {
+		return &requestError{Status: http.StatusInternalServerError, Message: "Failed to set custom user claims", Err: err}
+	}
+	if err := firebaseAuthClient.SetCustomUserClaims(ctx, user.UID, merged); err != nil {
+		return &requestError{Status: http.StatusInternalServerError, Message: "Failed to set custom user claims", Err: err}
+	}
+	log.Printf("Updated custom user claims of %s: %v", user.UID, claims)
+	return nil
+}
+
+// normalizeClaims round-trips claims through JSON so values built in Go
+// compare equal to the ones decoded from a user record.
+func normalizeClaims(claims map[string]interface{}) map[string]interface{} {
+	encoded, _ := json.Marshal(claims)
+	normalized := map[string]interface{}{}
+	json.Unmarshal(encoded, &normalized)
+	return normalized
+}
+
+// validateCustomClaims enforces Firebase's reserved-name and size limits so
+// an oversized or invalid claim set fails with a clear error.
+func validateCustomClaims(claims map[string]interface{}) error {
+	for claim := range claims {
+		if reservedClaims[claim] {
+			return fmt.Errorf("custom claim %q is reserved by Firebase", claim)
+		}
+	}
+	encoded, err := json.Marshal(claims)
+	if err != nil {
+		return fmt.Errorf("custom claims are not valid JSON: %v", err)
+	}
+	if len(encoded) > maxCustomClaimsBytes {
+		return fmt.Errorf("custom claims are %d bytes, exceeding Firebase's %d byte limit", len(encoded), maxCustomClaimsBytes)
+	}
+	return nil
+}
@@ -6,18 +6,41 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
 )
 
+// authClient is the part of the Firebase Auth client the sign-in code uses.
+// *auth.Client implements it; tests swap in a fake.
+type authClient interface {
+	GetUser(ctx context.Context, uid string) (*auth.UserRecord, error)
+	GetUserByEmail(ctx context.Context, email string) (*auth.UserRecord, error)
+	CreateUser(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error)
+	UpdateUser(ctx context.Context, uid string, user *auth.UserToUpdate) (*auth.UserRecord, error)
+	SetCustomUserClaims(ctx context.Context, uid string, customClaims map[string]interface{}) error
+	CustomTokenWithClaims(ctx context.Context, uid string, devClaims map[string]interface{}) (string, error)
+}
+
 var (
-	firebaseAuthClient *auth.Client
+	firebaseAuthClient authClient
 	AllowedOrigins     []string
+
+	setupOnce sync.Once
 )
 
-func init() {
+// ensureSetup loads the configuration and the Firebase Admin SDK the first
+// time an entry point is called.
+func ensureSetup() {
+	setupOnce.Do(setup)
+}
+
+// setup reads the environment and initializes the Firebase Admin SDK. A bad
+// configuration stops the instance.
+func setup() {
 	// --- 1. Initialize Allowed Origins (MANDATORY) ---
 	log.Println("Initializing CORS Allowed Origins...")
 	originsStr := os.Getenv("ALLOWED_ORIGINS")
@@ -34,9 +57,6 @@ func init() {
 
 	// --- 2. Initialize Firebase Admin SDK ---
 	log.Println("Initializing Firebase Admin SDK...")
-	if firebaseAuthClient != nil {
-		return // Already initialized
-	}
 	app, err := firebase.NewApp(context.Background(), nil)
 	if err != nil {
 		log.Fatalf("error initializing Firebase app: %v\n", err)
@@ -47,6 +67,66 @@ func init() {
 	}
 	firebaseAuthClient = client
 	log.Println("Firebase Admin SDK initialized successfully.")
+
+	// --- 3. Load Profile Sync Policy ---
+	loadProfileSyncPolicy()
+
+	// --- 4. Load Email Conflict Policy ---
+	loadEmailConflictPolicy()
+
+	// --- 5. Load Custom Claim Mappings ---
+	loadClaimMappings()
+
+	// --- 6. Load Email Sign-Up Policy ---
+	loadEmailSignUpPolicy()
+
+	// --- 7. Load Blocked Provider Subjects ---
+	loadBlockedSubjects()
+
+	// --- 8. Load Blocking Hooks ---
+	loadHookConfig()
+
+	// --- 9. Load Code Exchange Secrets ---
+	loadCodeExchanges()
+	loadAudiencePolicy()
+
+	// --- 10. Load Provider Access Policies ---
+	loadGitHubAccessPolicy()
+	loadMicrosoftRolePolicy()
+	loadMicrosoftIdentityOptions()
+	loadGoogleDomainPolicy()
+	loadInstagramLoginMode()
+	loadTikTokOptions()
+	loadXOptions()
+	loadLinkedInProfileClaims()
+
+	// --- 11. Load Nonce Policy ---
+	loadNoncePolicy(app)
+}
+
+// parseBoolEnv reads envKey as a boolean, treating an unset value as false.
+func parseBoolEnv(envKey string) bool {
+	value := strings.TrimSpace(os.Getenv(envKey))
+	if value == "" {
+		return false
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("FATAL: %s must be true or false, got %q", envKey, value)
+	}
+	return enabled
+}
+
+// parseLowerSet splits a comma-separated list into a set of trimmed,
+// lowercase entries.
+func parseLowerSet(list string) map[string]bool {
+	set := map[string]bool{}
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			set[entry] = true
+		}
+	}
+	return set
 }
 
 // setCorsHeaders is a shared utility function.
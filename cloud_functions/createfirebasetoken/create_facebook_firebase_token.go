@@ -2,12 +2,11 @@ package createfirebasetoken
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
-	"log"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"net/http"
-
-	"firebase.google.com/go/v4/auth"
+	"net/url"
 )
 
 type FacebookUserInfo struct {
@@ -22,68 +21,92 @@ type FacebookUserInfo struct {
 }
 
 func CreateFacebookFirebaseToken(w http.ResponseWriter, r *http.Request) {
-	setCorsHeaders(w, r)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
-	}
+	createFirebaseToken(w, r, "facebook")
+}
 
-	var reqBody struct {
-		AccessToken string `json:"accessToken"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
-	}
+type facebookUserInfoFetcher struct{}
 
-	url := fmt.Sprintf("https://graph.facebook.com/me?fields=id,name,email,picture&access_token=%s", reqBody.AccessToken)
-	req, _ := http.NewRequest("GET", url, nil)
+// facebookLimitedLoginTokens verifies the OIDC tokens the iOS SDK returns for
+// Limited Login. Its audiences are set by loadAudiencePolicy.
+var facebookLimitedLoginTokens = &jwtVerifier{
+	Keys:    newJWKSCache("https://limited.facebook.com/.well-known/oauth/openid/jwks/"),
+	Issuers: []string{"https://www.facebook.com"},
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to verify Facebook token", http.StatusUnauthorized)
-		return
+func (f facebookUserInfoFetcher) FetchProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	if reqBody.AuthenticationToken != "" {
+		return f.profileFromLimitedLogin(ctx, client, reqBody)
 	}
-	defer resp.Body.Close()
 
-	var userInfo FacebookUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		http.Error(w, "Failed to parse Facebook user info", http.StatusInternalServerError)
-		return
-	}
+	query := url.Values{}
+	query.Set("fields", "id,name,email,picture")
+	req := newFacebookGraphRequest(ctx, "/me", query, reqBody.AccessToken)
 
-	uid := userInfo.ID
-	_, err = firebaseAuthClient.GetUser(context.Background(), uid)
+	var userInfo FacebookUserInfo
+	rawUserInfo, err := fetchUserInfo(req, client, "Facebook", &userInfo)
 	if err != nil {
-		if !auth.IsUserNotFound(err) {
-			http.Error(w, "Error looking up Firebase user", http.StatusInternalServerError)
-			return
-		}
-		params := (&auth.UserToCreate{}).
-			UID(uid).
-			Email(userInfo.Email).
-			DisplayName(userInfo.Name).
-			PhotoURL(userInfo.Picture.Data.URL)
+		return ProviderProfile{}, err
+	}
 
-		userRecord, createErr := firebaseAuthClient.CreateUser(context.Background(), params)
-		if createErr != nil {
-			http.Error(w, "Failed to create new Firebase user", http.StatusInternalServerError)
-			return
+	if !reqBody.AudienceVerified {
+		if err := verifyFacebookAudience(ctx, client, reqBody.AccessToken, userInfo.ID); err != nil {
+			return ProviderProfile{}, err
 		}
-		log.Printf("Successfully created new user via Facebook: %s\n", userRecord.UID)
 	}
 
-	customToken, err := firebaseAuthClient.CustomToken(context.Background(), uid)
+	return ProviderProfile{
+		Provider:    "facebook",
+		UID:         userInfo.ID,
+		Email:       userInfo.Email,
+		DisplayName: userInfo.Name,
+		PhotoURL:    userInfo.Picture.Data.URL,
+		UserInfo:    rawUserInfo,
+	}, nil
+}
+
+// profileFromLimitedLogin signs in with a Limited Login authentication token,
+// which comes without a Graph access token. Its sub is the same app-scoped
+// user ID that /me reports. Nothing else ties the token to this sign-in, so
+// a nonce is required whatever NONCE_POLICY says.
+func (facebookUserInfoFetcher) profileFromLimitedLogin(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	if len(facebookLimitedLoginTokens.Audiences) == 0 {
+		return ProviderProfile{}, audienceNotConfiguredError("facebook")
+	}
+	if reqBody.Nonce == "" {
+		return ProviderProfile{}, nonceRequiredError()
+	}
+	reqBody.IDToken = reqBody.AuthenticationToken
+	claims, err := verifyIDToken(ctx, client, facebookLimitedLoginTokens, "Facebook", reqBody)
 	if err != nil {
-		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
-		return
+		return ProviderProfile{}, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"firebase_token": customToken})
+	return ProviderProfile{
+		Provider:    "facebook",
+		UID:         claims.String("sub"),
+		Email:       claims.String("email"),
+		DisplayName: claims.String("name"),
+		PhotoURL:    claims.String("picture"),
+		UserInfo:    claims,
+	}, nil
+}
+
+// newFacebookGraphRequest builds a Graph API GET request that carries
+// accessToken in the Authorization header rather than the URL, plus the
+// appsecret_proof Facebook checks when "Require App Secret" is enabled.
+func newFacebookGraphRequest(ctx context.Context, path string, query url.Values, accessToken string) *http.Request {
+	if secret := secretsFromEnv["facebook"].Secret; secret != "" {
+		query.Set("appsecret_proof", facebookAppSecretProof(accessToken, secret))
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://graph.facebook.com"+path+"?"+query.Encode(), nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	return req
+}
+
+// facebookAppSecretProof is the hex HMAC-SHA256 of accessToken keyed with the
+// app secret.
+func facebookAppSecretProof(accessToken, appSecret string) string {
+	mac := hmac.New(sha256.New, []byte(appSecret))
+	mac.Write([]byte(accessToken))
+	return hex.EncodeToString(mac.Sum(nil))
 }
@@ -0,0 +1,141 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// TokenRequest is the JSON body accepted by the token endpoints.
+type TokenRequest struct {
+	AccessToken string `json:"accessToken"`
+	IDToken     string `json:"idToken,omitempty"`
+
+	// AuthenticationToken is the OIDC token of Facebook Limited Login.
+	AuthenticationToken string `json:"authenticationToken,omitempty"`
+
+	// Nonce binds IDToken to this sign-in attempt; see consumeNonce.
+	Nonce string `json:"nonce,omitempty"`
+
+	// CSRFToken and CSRFCookie carry Google One Tap's g_csrf_token from the
+	// body and the cookie for its double-submit check.
+	CSRFToken  string `json:"g_csrf_token,omitempty"`
+	CSRFCookie string `json:"-"`
+
+	// AudienceVerified is set when the tokens come from this server's own code
+	// exchange, so they were necessarily issued to our client ID.
+	AudienceVerified bool `json:"-"`
+}
+
+// UserInfoFetcher is implemented by every provider. It verifies the
+// credentials in a TokenRequest with the provider and returns the user's
+// normalized profile, or a *requestError to send back to the client.
+type UserInfoFetcher interface {
+	FetchProfile(ctx context.Context, client *http.Client, req TokenRequest) (ProviderProfile, error)
+}
+
+// userInfoFetchers maps the URL path of CreateFirebaseToken to the provider
+// that handles it. The keys match the ones ExchangeAuthCode routes on.
+var userInfoFetchers = map[string]UserInfoFetcher{
+	"facebook":  facebookUserInfoFetcher{},
+	"github":    githubUserInfoFetcher{},
+	"google":    googleUserInfoFetcher{},
+	"instagram": instagramUserInfoFetcher{},
+	"linkedin":  linkedInUserInfoFetcher{},
+	"microsoft": microsoftUserInfoFetcher{},
+	"tiktok":    tikTokUserInfoFetcher{},
+	"x_twitter": xTwitterUserInfoFetcher{},
+}
+
+// CreateFirebaseToken is the public Cloud Function entry point for all
+// providers, routed on the URL path (e.g. /google), as ExchangeAuthCode is.
+func CreateFirebaseToken(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if _, ok := userInfoFetchers[path]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	createFirebaseToken(w, r, path)
+}
+
+// createFirebaseToken handles CORS and the request body, lets the provider's
+// fetcher resolve the profile and signs the user in.
+func createFirebaseToken(w http.ResponseWriter, r *http.Request, provider string) {
+	ensureSetup()
+	setCorsHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	reqBody, err := decodeTokenRequest(r)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkAudienceCheckAvailable(provider, reqBody); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	profile, err := userInfoFetchers[provider].FetchProfile(r.Context(), &http.Client{}, reqBody)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	signInWithProfile(w, profile)
+}
+
+// decodeTokenRequest reads a JSON TokenRequest, or the form that Google One
+// Tap posts to its login_uri with the ID token in the credential field.
+func decodeTokenRequest(r *http.Request) (TokenRequest, error) {
+	var reqBody TokenRequest
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		if err := r.ParseForm(); err != nil {
+			return reqBody, err
+		}
+		reqBody.IDToken = r.PostForm.Get("credential")
+		reqBody.CSRFToken = r.PostForm.Get("g_csrf_token")
+		if reqBody.IDToken == "" || reqBody.CSRFToken == "" {
+			return reqBody, errors.New("missing credential or g_csrf_token")
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		return reqBody, err
+	}
+
+	if cookie, err := r.Cookie("g_csrf_token"); err == nil {
+		reqBody.CSRFCookie = cookie.Value
+	}
+	return reqBody, nil
+}
+
+// fetchUserInfo calls a provider's userinfo endpoint and decodes the response
+// into v, returning the raw payload as well. Any failure to reach the
+// endpoint or a non-OK status is reported as an invalid token.
+func fetchUserInfo(req *http.Request, client *http.Client, providerName string, v interface{}) (map[string]interface{}, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &requestError{Status: http.StatusUnauthorized, Message: "Failed to verify " + providerName + " token", Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &requestError{Status: http.StatusUnauthorized, Message: "Failed to verify " + providerName + " token"}
+	}
+
+	rawUserInfo, err := decodeUserInfo(resp.Body, v)
+	if err != nil {
+		return nil, &requestError{Status: http.StatusInternalServerError, Message: "Failed to parse " + providerName + " user info", Err: err}
+	}
+	return rawUserInfo, nil
+}
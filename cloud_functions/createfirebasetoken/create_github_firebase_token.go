@@ -3,11 +3,12 @@ package createfirebasetoken
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
-
-	"firebase.google.com/go/v4/auth"
+	"strings"
 )
 
 type GitHubUserInfo struct {
@@ -18,100 +19,257 @@ type GitHubUserInfo struct {
 	Email     string `json:"email"`
 }
 
-func CreateGitHubFirebaseToken(w http.ResponseWriter, r *http.Request) {
-	setCorsHeaders(w, r)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
+// GitHubOrg is one entry of the /user/orgs response.
+type GitHubOrg struct {
+	Login string `json:"login"`
+}
+
+// GitHubTeam is one entry of the /user/teams response.
+type GitHubTeam struct {
+	Slug         string    `json:"slug"`
+	Organization GitHubOrg `json:"organization"`
+}
+
+// githubAccessPolicy restricts GitHub sign-ins to members of some
+// organizations and maps team memberships onto roles.
+type githubAccessPolicy struct {
+	// AllowedOrgs are lowercase organization logins. When set, users outside
+	// all of them are rejected.
+	AllowedOrgs map[string]bool
+	// RoleTeams are lowercase "org/team-slug" entries whose slugs become roles.
+	RoleTeams map[string]bool
+	// PersistRoles writes roles as custom user claims instead of token claims.
+	PersistRoles bool
+}
+
+var githubPolicy githubAccessPolicy
+
+// loadGitHubAccessPolicy reads GITHUB_ALLOWED_ORGS, GITHUB_ROLE_TEAMS and
+// GITHUB_ROLES_TARGET (token or user).
+func loadGitHubAccessPolicy() {
+	githubPolicy = githubAccessPolicy{
+		AllowedOrgs:  parseLowerSet(os.Getenv("GITHUB_ALLOWED_ORGS")),
+		RoleTeams:    parseLowerSet(os.Getenv("GITHUB_ROLE_TEAMS")),
+		PersistRoles: parseRolesTarget("GITHUB_ROLES_TARGET"),
 	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
+	if len(githubPolicy.AllowedOrgs) > 0 || len(githubPolicy.RoleTeams) > 0 {
+		log.Printf("INFO: Loaded GitHub access policy: %+v", githubPolicy)
 	}
+}
 
-	var reqBody struct {
-		AccessToken string `json:"accessToken"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+// GitHubEmail is one entry of the /user/emails response.
+type GitHubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
+func CreateGitHubFirebaseToken(w http.ResponseWriter, r *http.Request) {
+	createFirebaseToken(w, r, "github")
+}
+
+type githubUserInfoFetcher struct{}
+
+func (githubUserInfoFetcher) FetchProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	if !reqBody.AudienceVerified {
+		if err := verifyGitHubAudience(ctx, client, reqBody.AccessToken); err != nil {
+			return ProviderProfile{}, err
+		}
 	}
 
-	req, _ := http.NewRequest("GET", "https://api.github.com/user", nil)
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.github.com/user", nil)
 
 	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
 	req.Header.Add("Accept", "application/vnd.github+json")
 	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
 
-	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error contacting GitHub API: %v", err)
-		http.Error(w, "Failed to contact GitHub API", http.StatusInternalServerError)
-		return
+		return ProviderProfile{}, &requestError{Status: http.StatusInternalServerError, Message: "Failed to contact GitHub API", Err: err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("GitHub API returned non-OK status: %d", resp.StatusCode)
-		http.Error(w, "Failed to verify GitHub token", http.StatusUnauthorized)
-		return
+		return ProviderProfile{}, &requestError{Status: http.StatusUnauthorized, Message: "Failed to verify GitHub token"}
 	}
 
 	var userInfo GitHubUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		http.Error(w, "Failed to parse GitHub user info", http.StatusInternalServerError)
-		return
+	rawUserInfo, err := decodeUserInfo(resp.Body, &userInfo)
+	if err != nil {
+		return ProviderProfile{}, &requestError{Status: http.StatusInternalServerError, Message: "Failed to parse GitHub user info", Err: err}
 	}
 
-	if userInfo.Email == "" {
+	email := userInfo.Email
+	emailVerified := false
+	if githubScopeGranted(resp.Header, "user:email") {
+		primary, err := fetchGitHubPrimaryEmail(ctx, client, reqBody.AccessToken)
+		if err != nil {
+			log.Printf("Warning: failed to fetch emails for %s: %v", userInfo.Login, err)
+		} else if primary != "" {
+			email = primary
+			emailVerified = true
+		}
+	}
+	if email == "" {
 		log.Printf("User %s has a private email. Proceeding without one.", userInfo.Login)
 	}
 
-	uid := strconv.FormatInt(userInfo.ID, 10)
 	displayName := userInfo.Name
 	if displayName == "" {
 		displayName = userInfo.Login
 	}
 
-	user, err := firebaseAuthClient.GetUser(context.Background(), uid)
+	profile := ProviderProfile{
+		Provider:      "github",
+		UID:           strconv.FormatInt(userInfo.ID, 10),
+		Email:         email,
+		EmailVerified: emailVerified,
+		DisplayName:   displayName,
+		PhotoURL:      userInfo.AvatarURL,
+		UserInfo:      rawUserInfo,
+	}
+	if err := applyGitHubAccessPolicy(ctx, client, reqBody.AccessToken, resp.Header, userInfo.Login, &profile); err != nil {
+		return ProviderProfile{}, err
+	}
+	return profile, nil
+}
+
+// applyGitHubAccessPolicy rejects users outside the allowed organizations and
+// adds the slugs of their role teams to profile as "roles". Both need the
+// read:org scope; header is the /user response that reports the token's
+// scopes.
+func applyGitHubAccessPolicy(ctx context.Context, client *http.Client, accessToken string, header http.Header, login string, profile *ProviderProfile) error {
+	if len(githubPolicy.AllowedOrgs) == 0 && len(githubPolicy.RoleTeams) == 0 {
+		return nil
+	}
+	if !githubScopeGranted(header, "read:org", "write:org", "admin:org") {
+		log.Printf("Rejected GitHub user %s: token lacks the read:org scope.", login)
+		return &requestError{
+			Status:  http.StatusForbidden,
+			Code:    "missing-scope",
+			Message: "The GitHub token lacks the read:org scope required by the organization policy.",
+			Details: map[string]interface{}{"scope": "read:org"},
+		}
+	}
+
+	if len(githubPolicy.AllowedOrgs) > 0 {
+		orgs, err := githubGetAll[GitHubOrg](ctx, client, accessToken, "https://api.github.com/user/orgs?per_page=100")
+		if err != nil {
+			return &requestError{Status: http.StatusBadGateway, Message: "Failed to fetch GitHub organizations", Err: err}
+		}
+		allowed := false
+		for _, org := range orgs {
+			if githubPolicy.AllowedOrgs[strings.ToLower(org.Login)] {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			log.Printf("Rejected GitHub user %s: not a member of an allowed organization.", login)
+			return &requestError{
+				Status:  http.StatusForbidden,
+				Code:    "organization-not-allowed",
+				Message: "This GitHub account is not a member of an allowed organization.",
+			}
+		}
+	}
+
+	if len(githubPolicy.RoleTeams) == 0 {
+		return nil
+	}
+	teams, err := githubGetAll[GitHubTeam](ctx, client, accessToken, "https://api.github.com/user/teams?per_page=100")
 	if err != nil {
-		if !auth.IsUserNotFound(err) {
-			http.Error(w, "Error looking up Firebase user", http.StatusInternalServerError)
-			return
+		return &requestError{Status: http.StatusBadGateway, Message: "Failed to fetch GitHub teams", Err: err}
+	}
+	roles := []string{}
+	for _, team := range teams {
+		if githubPolicy.RoleTeams[strings.ToLower(team.Organization.Login+"/"+team.Slug)] {
+			roles = append(roles, team.Slug)
 		}
+	}
+	setRolesClaim(profile, roles, githubPolicy.PersistRoles)
+	return nil
+}
 
-		params := (&auth.UserToCreate{}).
-			UID(uid).
-			DisplayName(displayName).
-			PhotoURL(userInfo.AvatarURL)
-		
-		if userInfo.Email != "" {
-			params.Email(userInfo.Email)
+// githubScopeGranted reports whether the token behind a GitHub API response
+// carries one of scopes, or a broader scope that implies it. GitHub App tokens
+// do not send X-OAuth-Scopes, so a missing header is treated as granted and
+// the follow-up call is left to fail on its own.
+func githubScopeGranted(header http.Header, scopes ...string) bool {
+	scopesHeader := header.Values("X-OAuth-Scopes")
+	if len(scopesHeader) == 0 {
+		return true
+	}
+	for _, granted := range strings.Split(strings.Join(scopesHeader, ","), ",") {
+		granted = strings.TrimSpace(granted)
+		for _, scope := range scopes {
+			if granted == scope || granted == strings.SplitN(scope, ":", 2)[0] {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		userRecord, createErr := firebaseAuthClient.CreateUser(context.Background(), params)
-		if createErr != nil {
-			http.Error(w, "Failed to create new Firebase user", http.StatusInternalServerError)
-			return
+// fetchGitHubPrimaryEmail returns the user's primary email when GitHub has
+// verified it, or an empty string otherwise.
+func fetchGitHubPrimaryEmail(ctx context.Context, client *http.Client, accessToken string) (string, error) {
+	var emails []GitHubEmail
+	if _, err := githubGet(ctx, client, accessToken, "https://api.github.com/user/emails", &emails); err != nil {
+		return "", err
+	}
+	for _, e := range emails {
+		if e.Primary && e.Verified {
+			return e.Email, nil
 		}
-		log.Printf("Successfully created new user via GitHub: %s\n", userRecord.UID)
-	} else {
-		updateParams := (&auth.UserToUpdate{}).
-			DisplayName(displayName).
-			PhotoURL(userInfo.AvatarURL)
-		if _, updateErr := firebaseAuthClient.UpdateUser(context.Background(), uid, updateParams); updateErr != nil {
-			log.Printf("Warning: failed to update user %s: %v", uid, updateErr)
+	}
+	return "", nil
+}
+
+// githubGetAll reads every page of a GitHub list endpoint by following the
+// Link header's rel="next" URL.
+func githubGetAll[T any](ctx context.Context, client *http.Client, accessToken, url string) ([]T, error) {
+	items := []T{}
+	for url != "" {
+		var page []T
+		next, err := githubGet(ctx, client, accessToken, url, &page)
+		if err != nil {
+			return nil, err
 		}
-		log.Printf("User %s already exists, info updated.", user.UID)
+		items = append(items, page...)
+		url = next
 	}
+	return items, nil
+}
+
+// githubNextPage returns the rel="next" URL of a Link header, if any.
+func githubNextPage(header http.Header) string {
+	for _, link := range strings.Split(header.Get("Link"), ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if ok && strings.Contains(params, `rel="next"`) {
+			return strings.Trim(strings.TrimSpace(target), "<>")
+		}
+	}
+	return ""
+}
+
+// githubGet calls a GitHub REST endpoint with the user's token, decodes the
+// JSON response into v and returns the URL of the next page, if any.
+func githubGet(ctx context.Context, client *http.Client, accessToken, url string, v interface{}) (string, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
 
-	customToken, err := firebaseAuthClient.CustomToken(context.Background(), uid)
+	resp, err := client.Do(req)
 	if err != nil {
-		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
-		return
+		return "", err
 	}
+	defer resp.Body.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"firebase_token": customToken})
-}
\ No newline at end of file
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub API returned non-OK status: %d", resp.StatusCode)
+	}
+	return githubNextPage(resp.Header), json.NewDecoder(resp.Body).Decode(v)
+}
@@ -2,11 +2,10 @@ package createfirebasetoken
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"net/http"
-
-	"firebase.google.com/go/v4/auth"
+	"os"
+	"strings"
 )
 
 type GoogleUserInfo struct {
@@ -17,73 +16,137 @@ type GoogleUserInfo struct {
 	GivenName     string `json:"given_name"`
 	FamilyName    string `json:"family_name"`
 	Picture       string `json:"picture"`
+	HostedDomain  string `json:"hd"`
 }
 
-func CreateGoogleFirebaseToken(w http.ResponseWriter, r *http.Request) {
-	setCorsHeaders(w, r)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
+// googleDomainPolicy restricts Google sign-ins to Workspace accounts.
+type googleDomainPolicy struct {
+	// AllowedHostedDomains are lowercase Workspace domains. When set, accounts
+	// without a matching hd are rejected.
+	AllowedHostedDomains map[string]bool
+	// RequireVerifiedEmail rejects accounts whose email is not verified.
+	RequireVerifiedEmail bool
+}
+
+var googlePolicy googleDomainPolicy
+
+// loadGoogleDomainPolicy reads GOOGLE_ALLOWED_HOSTED_DOMAINS and
+// GOOGLE_REQUIRE_VERIFIED_EMAIL.
+func loadGoogleDomainPolicy() {
+	googlePolicy = googleDomainPolicy{
+		AllowedHostedDomains: parseLowerSet(os.Getenv("GOOGLE_ALLOWED_HOSTED_DOMAINS")),
+		RequireVerifiedEmail: parseBoolEnv("GOOGLE_REQUIRE_VERIFIED_EMAIL"),
 	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
+	if len(googlePolicy.AllowedHostedDomains) > 0 || googlePolicy.RequireVerifiedEmail {
+		log.Printf("INFO: Loaded Google domain policy: %+v", googlePolicy)
 	}
+}
 
-	var reqBody struct {
-		AccessToken string `json:"accessToken"`
+// checkGoogleDomainPolicy returns an error for accounts the policy rejects.
+func checkGoogleDomainPolicy(userInfo GoogleUserInfo) error {
+	if len(googlePolicy.AllowedHostedDomains) > 0 && !googlePolicy.AllowedHostedDomains[strings.ToLower(userInfo.HostedDomain)] {
+		log.Printf("Rejected Google user %s: hosted domain %q is not allowed.", userInfo.ID, userInfo.HostedDomain)
+		return &requestError{
+			Status:  http.StatusForbidden,
+			Code:    "hosted-domain-not-allowed",
+			Message: "This Google account does not belong to an allowed Workspace domain.",
+			Details: map[string]interface{}{"hosted_domain": userInfo.HostedDomain},
+		}
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	if googlePolicy.RequireVerifiedEmail && !userInfo.VerifiedEmail {
+		log.Printf("Rejected Google user %s: email is not verified.", userInfo.ID)
+		return &requestError{
+			Status:  http.StatusForbidden,
+			Code:    "email-not-verified",
+			Message: "This Google account's email address is not verified.",
+		}
 	}
+	return nil
+}
 
-	req, _ := http.NewRequest("GET", "https://www.googleapis.com/oauth2/v2/userinfo", nil)
-	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
+func CreateGoogleFirebaseToken(w http.ResponseWriter, r *http.Request) {
+	createFirebaseToken(w, r, "google")
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to verify Google token", http.StatusUnauthorized)
-		return
-	}
-	defer resp.Body.Close()
+type googleUserInfoFetcher struct{}
 
-	var userInfo GoogleUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		http.Error(w, "Failed to parse Google user info", http.StatusInternalServerError)
-		return
+// googleIDTokens verifies Google ID tokens. Its audiences are set by
+// loadAudiencePolicy.
+var googleIDTokens = &jwtVerifier{
+	Keys:    newJWKSCache("https://www.googleapis.com/oauth2/v3/certs"),
+	Issuers: []string{"https://accounts.google.com", "accounts.google.com"},
+}
+
+func (f googleUserInfoFetcher) FetchProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	if reqBody.IDToken != "" {
+		return f.profileFromIDToken(ctx, client, reqBody)
 	}
 
-	uid := userInfo.ID
-	_, err = firebaseAuthClient.GetUser(context.Background(), uid)
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://www.googleapis.com/oauth2/v2/userinfo", nil)
+	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
 
+	var userInfo GoogleUserInfo
+	rawUserInfo, err := fetchUserInfo(req, client, "Google", &userInfo)
 	if err != nil {
-		if !auth.IsUserNotFound(err) {
-			http.Error(w, "Error looking up Firebase user", http.StatusInternalServerError)
-			return
+		return ProviderProfile{}, err
+	}
+
+	if !reqBody.AudienceVerified {
+		if err := verifyGoogleAudience(ctx, client, reqBody.AccessToken, userInfo.ID); err != nil {
+			return ProviderProfile{}, err
 		}
-		params := (&auth.UserToCreate{}).
-			UID(uid).
-			Email(userInfo.Email).
-			EmailVerified(userInfo.VerifiedEmail).
-			DisplayName(userInfo.Name).
-			PhotoURL(userInfo.Picture)
-
-		userRecord, createErr := firebaseAuthClient.CreateUser(context.Background(), params)
-		if createErr != nil {
-			http.Error(w, "Failed to create new Firebase user", http.StatusInternalServerError)
-			return
+	}
+
+	return googleProfile(userInfo, rawUserInfo)
+}
+
+// profileFromIDToken verifies a Credential Manager or One Tap ID token
+// locally, so no userinfo call is needed. One Tap posts also carry a
+// g_csrf_token that must match the cookie of the same name.
+func (googleUserInfoFetcher) profileFromIDToken(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	if reqBody.CSRFToken != "" && reqBody.CSRFToken != reqBody.CSRFCookie {
+		log.Printf("Rejected Google One Tap credential: g_csrf_token does not match its cookie.")
+		return ProviderProfile{}, &requestError{
+			Status:  http.StatusForbidden,
+			Code:    "csrf-token-mismatch",
+			Message: "Failed to verify double submit cookie.",
 		}
-		log.Printf("Successfully created new user via Google: %s\n", userRecord.UID)
+	}
+	if len(googleIDTokens.Audiences) == 0 {
+		return ProviderProfile{}, audienceNotConfiguredError("google")
 	}
 
-	customToken, err := firebaseAuthClient.CustomToken(context.Background(), uid)
+	claims, err := verifyIDToken(ctx, client, googleIDTokens, "Google", reqBody)
 	if err != nil {
-		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
-		return
+		return ProviderProfile{}, err
+	}
+
+	userInfo := GoogleUserInfo{
+		ID:            claims.String("sub"),
+		Email:         claims.String("email"),
+		VerifiedEmail: claims.Bool("email_verified"),
+		Name:          claims.String("name"),
+		GivenName:     claims.String("given_name"),
+		FamilyName:    claims.String("family_name"),
+		Picture:       claims.String("picture"),
+		HostedDomain:  claims.String("hd"),
 	}
+	return googleProfile(userInfo, claims)
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"firebase_token": customToken})
-}
\ No newline at end of file
+// googleProfile applies the domain policy and builds the profile.
+func googleProfile(userInfo GoogleUserInfo, rawUserInfo map[string]interface{}) (ProviderProfile, error) {
+	if err := checkGoogleDomainPolicy(userInfo); err != nil {
+		return ProviderProfile{}, err
+	}
+
+	return ProviderProfile{
+		Provider:      "google",
+		UID:           userInfo.ID,
+		Email:         userInfo.Email,
+		EmailVerified: userInfo.VerifiedEmail,
+		DisplayName:   userInfo.Name,
+		PhotoURL:      userInfo.Picture,
+		UserInfo:      rawUserInfo,
+	}, nil
+}
@@ -2,100 +2,93 @@ package createfirebasetoken
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"log"
 	"net/http"
-
-	"firebase.google.com/go/v4/auth"
 )
 
-// InstagramUserInfo represents data from Instagram's basic profile endpoint.
+// InstagramUserInfo represents data from Instagram's /me endpoint. UserID,
+// Name, AccountType and ProfilePictureURL are only returned by the Instagram
+// API with Instagram Login.
 type InstagramUserInfo struct {
-	ID       string `json:"id"` // Unique, stable User ID
-	Username string `json:"username"`
+	ID                string `json:"id"` // Unique, stable User ID
+	UserID            string `json:"user_id"`
+	Username          string `json:"username"`
+	Name              string `json:"name"`
+	AccountType       string `json:"account_type"`
+	ProfilePictureURL string `json:"profile_picture_url"`
 }
 
-// CreateInstagramFirebaseToken is the public Cloud Function entry point for Instagram.
-func CreateInstagramFirebaseToken(w http.ResponseWriter, r *http.Request) {
-	// Assumes setCorsHeaders() is defined in a common.go file within the same package.
-	setCorsHeaders(w, r)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// instagramBasicDisplay keeps the retired Basic Display flow for apps that
+// have not migrated to Instagram Login yet.
+var instagramBasicDisplay bool
 
-	var reqBody struct {
-		AccessToken string `json:"accessToken"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+// loadInstagramLoginMode reads INSTAGRAM_BASIC_DISPLAY.
+func loadInstagramLoginMode() {
+	instagramBasicDisplay = parseBoolEnv("INSTAGRAM_BASIC_DISPLAY")
+	if instagramBasicDisplay {
+		log.Println("WARNING: Instagram uses the retired Basic Display API.")
 	}
+}
+
+// CreateInstagramFirebaseToken is the public Cloud Function entry point for Instagram.
+func CreateInstagramFirebaseToken(w http.ResponseWriter, r *http.Request) {
+	createFirebaseToken(w, r, "instagram")
+}
 
-	// 1. Verify the Instagram token by calling the /me endpoint.
-	url := fmt.Sprintf("https://graph.instagram.com/me?fields=id,username&access_token=%s", reqBody.AccessToken)
-	req, _ := http.NewRequest("GET", url, nil)
+type instagramUserInfoFetcher struct{}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to verify Instagram token", http.StatusUnauthorized)
-		return
+func (f instagramUserInfoFetcher) FetchProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	if !instagramBasicDisplay {
+		return f.fetchBusinessProfile(ctx, client, reqBody)
 	}
-	defer resp.Body.Close()
+
+	// Verify the Instagram token by calling the /me endpoint.
+	// The token goes in the Authorization header so it never ends up in a URL.
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://graph.instagram.com/me?fields=id,username", nil)
+	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
 
 	var userInfo InstagramUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		http.Error(w, "Failed to parse Instagram user info", http.StatusInternalServerError)
-		return
+	rawUserInfo, err := fetchUserInfo(req, client, "Instagram", &userInfo)
+	if err != nil {
+		return ProviderProfile{}, err
 	}
 
-	// 2. Get or Create Firebase User.
-	uid := userInfo.ID
+	// Basic Display doesn't provide a full name or photo URL.
+	return ProviderProfile{
+		Provider:    "instagram",
+		UID:         userInfo.ID,
+		DisplayName: userInfo.Username,
+		UserInfo:    rawUserInfo,
+	}, nil
+}
 
-	// First, check if the user exists. We only care about the error, so we
-	// use the blank identifier `_` for the user record here.
-	_, err = firebaseAuthClient.GetUser(context.Background(), uid)
+// fetchBusinessProfile reads the profile through the Instagram API with
+// Instagram Login, which works with both short- and long-lived tokens. The
+// UID is user_id, the professional account ID that the token exchange and
+// webhooks report as well.
+func (instagramUserInfoFetcher) fetchBusinessProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://graph.instagram.com/v21.0/me?fields=user_id,username,name,account_type,profile_picture_url", nil)
+	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
 
-	// We only enter this block if GetUser returned an error.
+	var userInfo InstagramUserInfo
+	rawUserInfo, err := fetchUserInfo(req, client, "Instagram", &userInfo)
 	if err != nil {
-		// Check if the error was specifically "user not found".
-		if !auth.IsUserNotFound(err) {
-			// If it's some other error (network, etc.), fail the request.
-			http.Error(w, "Error looking up Firebase user", http.StatusInternalServerError)
-			return
-		}
-
-		// The user was not found, so we create them now.
-		params := (&auth.UserToCreate{}).
-			UID(uid).
-			DisplayName(userInfo.Username) // Instagram doesn't provide a full name or photo URL here
-
-		// --- THIS IS THE FIX ---
-		// Declare `userRecord` with `:=` to create a new variable scoped to this block.
-		userRecord, createErr := firebaseAuthClient.CreateUser(context.Background(), params)
-		if createErr != nil {
-			http.Error(w, "Failed to create new Firebase user", http.StatusInternalServerError)
-			return
-		}
-
-		// The userRecord is now correctly used for logging.
-		log.Printf("Successfully created new user via Instagram: %s\n", userRecord.UID)
+		return ProviderProfile{}, err
+	}
+	if userInfo.UserID == "" {
+		return ProviderProfile{}, &requestError{Status: http.StatusBadGateway, Message: "Instagram profile did not include a user_id"}
 	}
 
-	// 3. Mint the Custom Token for the user (who now definitely exists).
-	customToken, err := firebaseAuthClient.CustomToken(context.Background(), uid)
-	if err != nil {
-		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
-		return
+	displayName := userInfo.Name
+	if displayName == "" {
+		displayName = userInfo.Username
 	}
 
-	// 4. Send the token back to the client.
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"firebase_token": customToken})
+	return ProviderProfile{
+		Provider:    "instagram",
+		UID:         userInfo.UserID,
+		DisplayName: displayName,
+		PhotoURL:    userInfo.ProfilePictureURL,
+		UserInfo:    rawUserInfo,
+	}, nil
 }
@@ -2,85 +2,134 @@ package createfirebasetoken
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"net/http"
-
-	"firebase.google.com/go/v4/auth"
 )
 
 type LinkedInUserInfo struct {
-	Sub     string `json:"sub"`
-	Name    string `json:"name"`
-	Picture string `json:"picture"`
-	Email   string `json:"email"`
+	Sub           string      `json:"sub"`
+	Name          string      `json:"name"`
+	GivenName     string      `json:"given_name"`
+	FamilyName    string      `json:"family_name"`
+	Picture       string      `json:"picture"`
+	Email         string      `json:"email"`
+	EmailVerified bool        `json:"email_verified"`
+	Locale        interface{} `json:"locale"`
 }
 
-func CreateLinkedInFirebaseToken(w http.ResponseWriter, r *http.Request) {
-	setCorsHeaders(w, r)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// linkedInProfileClaims writes given_name, family_name and locale as claims.
+type linkedInProfileClaims struct {
+	Enabled bool
+	// Persist writes them as custom user claims instead of token claims.
+	Persist bool
+}
+
+var linkedInClaims linkedInProfileClaims
 
-	var reqBody struct {
-		AccessToken string `json:"accessToken"`
+// loadLinkedInProfileClaims reads LINKEDIN_PROFILE_CLAIMS and
+// LINKEDIN_PROFILE_CLAIMS_TARGET (token or user).
+func loadLinkedInProfileClaims() {
+	linkedInClaims = linkedInProfileClaims{
+		Enabled: parseBoolEnv("LINKEDIN_PROFILE_CLAIMS"),
+		Persist: parseRolesTarget("LINKEDIN_PROFILE_CLAIMS_TARGET"),
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	if linkedInClaims.Enabled {
+		log.Printf("INFO: Loaded LinkedIn profile claims: %+v", linkedInClaims)
 	}
+}
 
-	req, _ := http.NewRequest("GET", "https://api.linkedin.com/v2/userinfo", nil)
-	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
+func CreateLinkedInFirebaseToken(w http.ResponseWriter, r *http.Request) {
+	createFirebaseToken(w, r, "linkedin")
+}
+
+type linkedInUserInfoFetcher struct{}
+
+// linkedInIDTokens verifies LinkedIn's OpenID Connect ID tokens. Its audiences
+// are set by loadAudiencePolicy.
+var linkedInIDTokens = &jwtVerifier{
+	Keys:    newJWKSCache("https://www.linkedin.com/oauth/openid/jwks"),
+	Issuers: []string{"https://www.linkedin.com/oauth"},
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to verify LinkedIn token", http.StatusUnauthorized)
-		return
+func (linkedInUserInfoFetcher) FetchProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	if reqBody.IDToken != "" {
+		claims, err := verifyIDToken(ctx, client, linkedInIDTokens, "LinkedIn", reqBody)
+		if err != nil {
+			return ProviderProfile{}, err
+		}
+		return linkedInProfile(LinkedInUserInfo{
+			Sub:           claims.String("sub"),
+			Name:          claims.String("name"),
+			GivenName:     claims.String("given_name"),
+			FamilyName:    claims.String("family_name"),
+			Picture:       claims.String("picture"),
+			Email:         claims.String("email"),
+			EmailVerified: claims.Bool("email_verified"),
+			Locale:        claims["locale"],
+		}, claims), nil
 	}
-	defer resp.Body.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://api.linkedin.com/v2/userinfo", nil)
+	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
 
 	var userInfo LinkedInUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		http.Error(w, "Failed to parse LinkedIn user info", http.StatusInternalServerError)
-		return
+	rawUserInfo, err := fetchUserInfo(req, client, "LinkedIn", &userInfo)
+	if err != nil {
+		return ProviderProfile{}, err
 	}
 
-	uid := userInfo.Sub
+	return linkedInProfile(userInfo, rawUserInfo), nil
+}
 
-	_, err = firebaseAuthClient.GetUser(context.Background(), uid)
+// linkedInProfile builds the profile. Unverified emails are dropped, so they
+// are never stored or used to match an existing account.
+func linkedInProfile(userInfo LinkedInUserInfo, rawUserInfo map[string]interface{}) ProviderProfile {
+	profile := ProviderProfile{
+		Provider:      "linkedin",
+		UID:           userInfo.Sub,
+		Email:         userInfo.Email,
+		EmailVerified: userInfo.EmailVerified,
+		DisplayName:   userInfo.Name,
+		PhotoURL:      userInfo.Picture,
+		UserInfo:      rawUserInfo,
+	}
+	if profile.Email != "" && !profile.EmailVerified {
+		log.Printf("Ignoring unverified email of LinkedIn user %s.", profile.UID)
+		profile.Email = ""
+	}
 
-	if err != nil {
-		if !auth.IsUserNotFound(err) {
-			http.Error(w, "Error looking up Firebase user", http.StatusInternalServerError)
-			return
+	if linkedInClaims.Enabled {
+		target := &profile.Claims
+		if linkedInClaims.Persist {
+			target = &profile.UserClaims
 		}
-		params := (&auth.UserToCreate{}).
-			UID(uid).
-			DisplayName(userInfo.Name).
-			PhotoURL(userInfo.Picture).
-			Email(userInfo.Email)
-
-		userRecord, createErr := firebaseAuthClient.CreateUser(context.Background(), params)
-		if createErr != nil {
-			http.Error(w, "Failed to create new Firebase user", http.StatusInternalServerError)
-			return
+		*target = map[string]interface{}{}
+		for claim, value := range map[string]string{
+			"given_name":  userInfo.GivenName,
+			"family_name": userInfo.FamilyName,
+			"locale":      linkedInLocale(userInfo.Locale),
+		} {
+			if value != "" {
+				(*target)[claim] = value
+			}
 		}
-		log.Printf("Successfully created new user via LinkedIn: %s\n", userRecord.UID)
 	}
+	return profile
+}
 
-	customToken, err := firebaseAuthClient.CustomToken(context.Background(), uid)
-	if err != nil {
-		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
-		return
+// linkedInLocale formats the locale, which userinfo returns as
+// {"language":"en","country":"US"} and ID tokens may carry as a string.
+func linkedInLocale(locale interface{}) string {
+	switch locale := locale.(type) {
+	case string:
+		return locale
+	case map[string]interface{}:
+		language, _ := locale["language"].(string)
+		country, _ := locale["country"].(string)
+		if language != "" && country != "" {
+			return language + "_" + country
+		}
+		return language
 	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"firebase_token": customToken})
+	return ""
 }
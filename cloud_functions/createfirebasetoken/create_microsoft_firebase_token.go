@@ -3,86 +3,431 @@ package createfirebasetoken
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
-
-	"firebase.google.com/go/v4/auth"
+	"net/url"
+	"os"
+	"strings"
 )
 
 type MicrosoftUserInfo struct {
-	ID                string `json:"id"` 
+	ID                string `json:"id"`
 	DisplayName       string `json:"displayName"`
 	UserPrincipalName string `json:"userPrincipalName"`
 	Mail              string `json:"mail"`
 }
 
-func CreateMicrosoftFirebaseToken(w http.ResponseWriter, r *http.Request) {
-	setCorsHeaders(w, r)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
+// microsoftDirectoryObject is one entry of a Graph collection such as
+// /me/transitiveMemberOf or /me/appRoleAssignments.
+type microsoftDirectoryObject struct {
+	ID         string `json:"id"`
+	AppRoleID  string `json:"appRoleId"`
+	ResourceID string `json:"resourceId"`
+}
+
+// microsoftRolePolicy maps Entra group and app-role memberships onto roles.
+type microsoftRolePolicy struct {
+	// RoleMap maps lowercase "group:<object id>" and "role:<app role>" keys
+	// to role names. An app role is matched by its value, as found in the ID
+	// token's roles claim, or by its ID, as returned by Graph.
+	RoleMap map[string]string
+	// ResourceID is the object ID of this app's service principal. Graph app
+	// role assignments to other apps are ignored.
+	ResourceID string
+	// RequiredRoles, when set, rejects users with none of these mapped roles.
+	RequiredRoles map[string]bool
+	// PersistRoles writes roles as custom user claims instead of token claims.
+	PersistRoles bool
+}
+
+var microsoftPolicy microsoftRolePolicy
+
+// microsoftConsumersTenantID is the tid of personal Microsoft accounts.
+const microsoftConsumersTenantID = "9188040d-6c67-4c5b-b112-36a304b66dad"
+
+// Values of MICROSOFT_ACCOUNT_TYPES.
+const (
+	microsoftAccountsBoth     = "both"
+	microsoftAccountsPersonal = "personal"
+	microsoftAccountsWork     = "work"
+)
+
+// microsoftIdentityOptions decides how Microsoft users are identified.
+type microsoftIdentityOptions struct {
+	// UseGraphID keeps the legacy UIDs, Graph's id, instead of tid:oid. ID
+	// token sign-ins then also need the access token to read that id.
+	UseGraphID bool
+	// AccountTypes is both, personal or work.
+	AccountTypes string
+}
+
+var microsoftIdentity microsoftIdentityOptions
+
+// loadMicrosoftIdentityOptions reads MICROSOFT_UID_SOURCE (tid_oid or
+// graph_id) and MICROSOFT_ACCOUNT_TYPES (both, personal or work).
+func loadMicrosoftIdentityOptions() {
+	microsoftIdentity = microsoftIdentityOptions{AccountTypes: microsoftAccountsBoth}
+	switch source := strings.ToLower(strings.TrimSpace(os.Getenv("MICROSOFT_UID_SOURCE"))); source {
+	case "", "tid_oid":
+	case "graph_id":
+		microsoftIdentity.UseGraphID = true
+	default:
+		log.Fatalf("FATAL: MICROSOFT_UID_SOURCE must be tid_oid or graph_id, got %q", source)
 	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
+	switch accountTypes := strings.ToLower(strings.TrimSpace(os.Getenv("MICROSOFT_ACCOUNT_TYPES"))); accountTypes {
+	case "", microsoftAccountsBoth:
+	case microsoftAccountsPersonal, microsoftAccountsWork:
+		microsoftIdentity.AccountTypes = accountTypes
+	default:
+		log.Fatalf("FATAL: MICROSOFT_ACCOUNT_TYPES must be one of both, personal or work, got %q", accountTypes)
 	}
+	log.Printf("INFO: Loaded Microsoft identity options: %+v", microsoftIdentity)
+}
 
-	var reqBody struct {
-		AccessToken string `json:"accessToken"`
+// loadMicrosoftRolePolicy reads MICROSOFT_ROLE_MAP, a comma-separated list of
+// group:<id>=role and role:<value or id>=role entries, MICROSOFT_APP_RESOURCE_ID,
+// MICROSOFT_REQUIRED_ROLES and MICROSOFT_ROLES_TARGET (token or user).
+func loadMicrosoftRolePolicy() {
+	microsoftPolicy = microsoftRolePolicy{
+		RoleMap:       map[string]string{},
+		ResourceID:    strings.TrimSpace(os.Getenv("MICROSOFT_APP_RESOURCE_ID")),
+		RequiredRoles: parseLowerSet(os.Getenv("MICROSOFT_REQUIRED_ROLES")),
+		PersistRoles:  parseRolesTarget("MICROSOFT_ROLES_TARGET"),
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	for _, entry := range strings.Split(os.Getenv("MICROSOFT_ROLE_MAP"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, role, ok := strings.Cut(entry, "=")
+		key, role = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(role)
+		if !ok || role == "" || !(strings.HasPrefix(key, "group:") || strings.HasPrefix(key, "role:")) {
+			log.Fatalf("FATAL: MICROSOFT_ROLE_MAP entry %q must have the form group:<id>=role or role:<app role>=role", entry)
+		}
+		microsoftPolicy.RoleMap[key] = role
+	}
+	if len(microsoftPolicy.RequiredRoles) > 0 && len(microsoftPolicy.RoleMap) == 0 {
+		log.Fatal("FATAL: MICROSOFT_REQUIRED_ROLES is set but MICROSOFT_ROLE_MAP is empty")
+	}
+	if len(microsoftPolicy.RoleMap) > 0 {
+		log.Printf("INFO: Loaded Microsoft role policy: %+v", microsoftPolicy)
 	}
+}
 
-	req, _ := http.NewRequest("GET", "https://graph.microsoft.com/v1.0/me", nil)
-	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
+func CreateMicrosoftFirebaseToken(w http.ResponseWriter, r *http.Request) {
+	createFirebaseToken(w, r, "microsoft")
+}
+
+type microsoftUserInfoFetcher struct{}
+
+// microsoftIDTokens verifies Microsoft identity platform v2.0 ID tokens from
+// any tenant. Its audiences are set by loadAudiencePolicy.
+var microsoftIDTokens = &jwtVerifier{
+	Keys:    newJWKSCache("https://login.microsoftonline.com/common/discovery/v2.0/keys"),
+	Issuers: []string{"https://login.microsoftonline.com/{tenantid}/v2.0"},
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to verify Microsoft token", http.StatusUnauthorized)
-		return
+func (f microsoftUserInfoFetcher) FetchProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	if reqBody.IDToken != "" {
+		return f.profileFromIDToken(ctx, client, reqBody)
+	}
+	if !microsoftIdentity.UseGraphID || microsoftIdentity.AccountTypes != microsoftAccountsBoth {
+		return ProviderProfile{}, &requestError{Status: http.StatusBadRequest, Message: "Missing required parameter: idToken"}
 	}
-	defer resp.Body.Close()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://graph.microsoft.com/v1.0/me", nil)
+	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
 
 	var userInfo MicrosoftUserInfo
-	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
-		http.Error(w, "Failed to parse Microsoft user info", http.StatusInternalServerError)
-		return
+	rawUserInfo, err := fetchUserInfo(req, client, "Microsoft", &userInfo)
+	if err != nil {
+		return ProviderProfile{}, err
+	}
+
+	profile := ProviderProfile{
+		Provider:    "microsoft",
+		UID:         userInfo.ID,
+		Email:       microsoftEmail(userInfo.Mail, userInfo.UserPrincipalName),
+		DisplayName: userInfo.DisplayName,
+		UserInfo:    rawUserInfo,
+	}
+	if err := applyMicrosoftRolePolicy(ctx, client, nil, reqBody.AccessToken, &profile); err != nil {
+		return ProviderProfile{}, err
+	}
+	return profile, nil
+}
+
+// profileFromIDToken builds the profile from a verified ID token instead of
+// Graph's /me. The UID is tid:oid, the user's object ID qualified by its
+// tenant, so the same person signing in with a personal and a work account,
+// or as a guest of several tenants, gets one Firebase user per identity. With
+// MICROSOFT_UID_SOURCE graph_id, the UID is the Graph id of the same user,
+// which differs from the oid for personal accounts.
+func (microsoftUserInfoFetcher) profileFromIDToken(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	claims, err := verifyIDToken(ctx, client, microsoftIDTokens, "Microsoft", reqBody)
+	if err != nil {
+		return ProviderProfile{}, err
+	}
+	if claims.String("tid") == "" || claims.String("oid") == "" {
+		return ProviderProfile{}, invalidIDTokenError("Microsoft", errors.New("token has no tid or oid claim"))
+	}
+	if err := checkMicrosoftAccountType(claims); err != nil {
+		return ProviderProfile{}, err
+	}
+
+	uid := claims.String("tid") + ":" + claims.String("oid")
+	if microsoftIdentity.UseGraphID {
+		if reqBody.AccessToken == "" {
+			return ProviderProfile{}, &requestError{Status: http.StatusBadRequest, Message: "Missing required parameter: accessToken (needed for MICROSOFT_UID_SOURCE graph_id)"}
+		}
+		if uid, err = fetchMicrosoftGraphID(ctx, client, reqBody.AccessToken, claims); err != nil {
+			return ProviderProfile{}, err
+		}
+	}
+
+	profile := ProviderProfile{
+		Provider:    "microsoft",
+		UID:         uid,
+		Email:       microsoftEmail(claims.String("email"), claims.String("preferred_username")),
+		DisplayName: claims.String("name"),
+		UserInfo:    claims,
+	}
+	if err := applyMicrosoftRolePolicy(ctx, client, claims, reqBody.AccessToken, &profile); err != nil {
+		return ProviderProfile{}, err
+	}
+	return profile, nil
+}
+
+// microsoftEmail prefers mail over the user principal name. Guest UPNs such
+// as alice_contoso.com#EXT#@fabrikam.onmicrosoft.com are turned back into the
+// guest's own address, alice@contoso.com.
+func microsoftEmail(mail, upn string) string {
+	if mail != "" {
+		return mail
+	}
+	guest, _, isGuest := strings.Cut(upn, "#EXT#")
+	if !isGuest {
+		return upn
+	}
+	at := strings.LastIndex(guest, "_")
+	if at < 0 {
+		return ""
+	}
+	return guest[:at] + "@" + guest[at+1:]
+}
+
+// checkMicrosoftAccountType rejects personal or work accounts when the app is
+// restricted to the other kind.
+func checkMicrosoftAccountType(claims jwtClaims) error {
+	personal := claims.String("tid") == microsoftConsumersTenantID
+	switch {
+	case microsoftIdentity.AccountTypes == microsoftAccountsPersonal && !personal,
+		microsoftIdentity.AccountTypes == microsoftAccountsWork && personal:
+		log.Printf("Rejected Microsoft user %s: account type is not allowed.", claims.String("oid"))
+		return &requestError{
+			Status:  http.StatusForbidden,
+			Code:    "account-type-not-allowed",
+			Message: "This type of Microsoft account cannot be used to sign in.",
+			Details: map[string]interface{}{"personal_account": personal},
+		}
+	}
+	return nil
+}
+
+// applyMicrosoftRolePolicy maps the user's groups and app roles through the
+// role map, rejects users without a required role and writes the roles onto
+// profile. Memberships come from the verified ID token's claims when there is
+// one, and from Graph for sign-ins with an access token only.
+func applyMicrosoftRolePolicy(ctx context.Context, client *http.Client, claims jwtClaims, accessToken string, profile *ProviderProfile) error {
+	if len(microsoftPolicy.RoleMap) == 0 {
+		return nil
 	}
 
-	uid := userInfo.ID
-	email := userInfo.Mail
-	if email == "" {
-		email = userInfo.UserPrincipalName
+	var keys []string
+	var err error
+	if claims != nil {
+		keys, err = microsoftTokenMemberships(ctx, client, claims, accessToken)
+	} else {
+		keys, err = microsoftGraphMemberships(ctx, client, accessToken)
 	}
-	
-	_, err = firebaseAuthClient.GetUser(context.Background(), uid)
 	if err != nil {
-		if !auth.IsUserNotFound(err) {
-			http.Error(w, "Error looking up Firebase user", http.StatusInternalServerError)
-			return
+		return err
+	}
+
+	roles := []string{}
+	seen := map[string]bool{}
+	hasRequired := len(microsoftPolicy.RequiredRoles) == 0
+	for _, key := range keys {
+		role, ok := microsoftPolicy.RoleMap[key]
+		if !ok || seen[role] {
+			continue
+		}
+		seen[role] = true
+		roles = append(roles, role)
+		if microsoftPolicy.RequiredRoles[strings.ToLower(role)] {
+			hasRequired = true
+		}
+	}
+
+	if !hasRequired {
+		log.Printf("Rejected Microsoft user %s: none of the required roles.", profile.UID)
+		return &requestError{
+			Status:  http.StatusForbidden,
+			Code:    "role-required",
+			Message: "This Microsoft account has none of the roles required to sign in.",
 		}
-		params := (&auth.UserToCreate{}).
-			UID(uid).
-			Email(email).
-			DisplayName(userInfo.DisplayName)
-		
-		userRecord, createErr := firebaseAuthClient.CreateUser(context.Background(), params)
-		if createErr != nil {
-			http.Error(w, "Failed to create new Firebase user", http.StatusInternalServerError)
-			return
+	}
+	setRolesClaim(profile, roles, microsoftPolicy.PersistRoles)
+	return nil
+}
+
+// microsoftTokenMemberships returns the role-map keys for the roles and groups
+// claims of an ID token. When the user is in too many groups for the token,
+// Entra leaves groups out and names it in _claim_names instead (the group
+// overage case); only then are the groups read from Graph.
+func microsoftTokenMemberships(ctx context.Context, client *http.Client, claims jwtClaims, accessToken string) ([]string, error) {
+	keys := []string{}
+	for _, role := range claims.Strings("roles") {
+		keys = append(keys, "role:"+strings.ToLower(role))
+	}
+	claimNames, _ := claims["_claim_names"].(map[string]interface{})
+	if _, overage := claimNames["groups"]; !overage && !claims.Bool("hasgroups") {
+		for _, group := range claims.Strings("groups") {
+			keys = append(keys, "group:"+strings.ToLower(group))
 		}
-		log.Printf("Successfully created new user via Microsoft: %s\n", userRecord.UID)
+		return keys, nil
+	}
+	if !microsoftPolicy.mapsAny("group:") {
+		return keys, nil
 	}
 
-	customToken, err := firebaseAuthClient.CustomToken(context.Background(), uid)
+	if accessToken == "" {
+		return nil, &requestError{Status: http.StatusBadRequest, Message: "Missing required parameter: accessToken (needed to read the groups of this Microsoft user)"}
+	}
+	if _, err := fetchMicrosoftGraphID(ctx, client, accessToken, claims); err != nil {
+		return nil, err
+	}
+	groups, err := fetchMicrosoftCollection(ctx, client, accessToken, "https://graph.microsoft.com/v1.0/me/transitiveMemberOf/microsoft.graph.group?$select=id")
+	if err != nil {
+		return nil, &requestError{Status: http.StatusBadGateway, Message: "Failed to fetch Microsoft group memberships", Err: err}
+	}
+	for _, group := range groups {
+		keys = append(keys, "group:"+strings.ToLower(group.ID))
+	}
+	return keys, nil
+}
+
+// microsoftGraphMemberships returns the role-map keys for sign-ins without an
+// ID token. Groups come from /me/transitiveMemberOf, so nested groups count.
+// App roles are this app's assignments to the user and to the groups the user
+// is a direct member of, which is how Entra grants roles through groups.
+func microsoftGraphMemberships(ctx context.Context, client *http.Client, accessToken string) ([]string, error) {
+	keys := []string{}
+	if microsoftPolicy.mapsAny("group:") {
+		groups, err := fetchMicrosoftCollection(ctx, client, accessToken, "https://graph.microsoft.com/v1.0/me/transitiveMemberOf/microsoft.graph.group?$select=id")
+		if err != nil {
+			return nil, &requestError{Status: http.StatusBadGateway, Message: "Failed to fetch Microsoft group memberships", Err: err}
+		}
+		for _, group := range groups {
+			keys = append(keys, "group:"+strings.ToLower(group.ID))
+		}
+	}
+	if !microsoftPolicy.mapsAny("role:") {
+		return keys, nil
+	}
+
+	if microsoftPolicy.ResourceID == "" {
+		return nil, &requestError{Status: http.StatusInternalServerError, Message: "MICROSOFT_APP_RESOURCE_ID must be set to read Microsoft app roles from Graph"}
+	}
+	assignments, err := fetchMicrosoftCollection(ctx, client, accessToken, "https://graph.microsoft.com/v1.0/me/appRoleAssignments?$select=appRoleId,resourceId")
 	if err != nil {
-		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
-		return
+		return nil, &requestError{Status: http.StatusBadGateway, Message: "Failed to fetch Microsoft app roles", Err: err}
 	}
-	
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"firebase_token": customToken})
-}
\ No newline at end of file
+	directGroups, err := fetchMicrosoftCollection(ctx, client, accessToken, "https://graph.microsoft.com/v1.0/me/memberOf/microsoft.graph.group?$select=id")
+	if err != nil {
+		return nil, &requestError{Status: http.StatusBadGateway, Message: "Failed to fetch Microsoft group memberships", Err: err}
+	}
+	for _, group := range directGroups {
+		groupAssignments, err := fetchMicrosoftCollection(ctx, client, accessToken, "https://graph.microsoft.com/v1.0/groups/"+url.PathEscape(group.ID)+"/appRoleAssignments?$select=appRoleId,resourceId")
+		if err != nil {
+			return nil, &requestError{Status: http.StatusBadGateway, Message: "Failed to fetch Microsoft app roles", Err: err}
+		}
+		assignments = append(assignments, groupAssignments...)
+	}
+	for _, assignment := range assignments {
+		if strings.EqualFold(assignment.ResourceID, microsoftPolicy.ResourceID) {
+			keys = append(keys, "role:"+strings.ToLower(assignment.AppRoleID))
+		}
+	}
+	return keys, nil
+}
+
+// fetchMicrosoftGraphID returns the Graph id of the user accessToken belongs
+// to, and rejects it unless that user is the oid of the verified ID token. The
+// access token is not verified by itself, so without this check a sign-in
+// could borrow the UID or groups of whoever the access token was issued to. Graph
+// reports personal accounts by the last 16 hex digits of their oid.
+func fetchMicrosoftGraphID(ctx context.Context, client *http.Client, accessToken string, claims jwtClaims) (string, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", "https://graph.microsoft.com/v1.0/me?$select=id", nil)
+	req.Header.Add("Authorization", "Bearer "+accessToken)
+
+	var me struct {
+		ID string `json:"id"`
+	}
+	if _, err := fetchUserInfo(req, client, "Microsoft", &me); err != nil {
+		return "", err
+	}
+	normalize := func(id string) string {
+		return strings.TrimLeft(strings.ToLower(strings.ReplaceAll(id, "-", "")), "0")
+	}
+	if me.ID == "" || normalize(me.ID) != normalize(claims.String("oid")) {
+		log.Printf("Rejected Microsoft user %s: access token belongs to %q.", claims.String("oid"), me.ID)
+		return "", &requestError{
+			Status:  http.StatusUnauthorized,
+			Code:    "access-token-mismatch",
+			Message: "The access token does not belong to the signed-in Microsoft user.",
+		}
+	}
+	return me.ID, nil
+}
+
+// mapsAny reports whether the role map has an entry with the given prefix.
+func (p microsoftRolePolicy) mapsAny(prefix string) bool {
+	for key := range p.RoleMap {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchMicrosoftCollection reads every page of a Graph collection.
+func fetchMicrosoftCollection(ctx context.Context, client *http.Client, accessToken, pageURL string) ([]microsoftDirectoryObject, error) {
+	objects := []microsoftDirectoryObject{}
+	for pageURL != "" {
+		req, _ := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+		req.Header.Add("Authorization", "Bearer "+accessToken)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Value    []microsoftDirectoryObject `json:"value"`
+			NextLink string                     `json:"@odata.nextLink"`
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("Graph API returned non-OK status: %d", resp.StatusCode)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, page.Value...)
+		pageURL = page.NextLink
+	}
+	return objects, nil
+}
@@ -2,90 +2,127 @@ package createfirebasetoken
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-
-	"firebase.google.com/go/v4/auth"
+	"os"
+	"strings"
 )
 
 type TikTokUserInfo struct {
-	OpenID      string `json:"open_id"`
-	AvatarURL   string `json:"avatar_url_100"`
-	DisplayName string `json:"display_name"`
+	OpenID         string `json:"open_id"`
+	UnionID        string `json:"union_id"`
+	AvatarURL      string `json:"avatar_url_100"`
+	DisplayName    string `json:"display_name"`
+	Username       string `json:"username"`
+	BioDescription string `json:"bio_description"`
+	IsVerified     bool   `json:"is_verified"`
 }
 
-func CreateTikTokFirebaseToken(w http.ResponseWriter, r *http.Request) {
-	setCorsHeaders(w, r)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// tikTokOptions configures how TikTok users are identified and which fields
+// are requested.
+type tikTokOptions struct {
+	// UseUnionID keys users on union_id, which is shared by all apps of the
+	// same developer, instead of the per-app open_id.
+	UseUnionID bool
+	// ProfileFields requests username, bio_description and is_verified,
+	// which need the user.info.profile scope, and writes them as claims.
+	ProfileFields bool
+	// PersistProfileFields writes them as custom user claims instead of token
+	// claims.
+	PersistProfileFields bool
+}
+
+var tikTok tikTokOptions
 
-	var reqBody struct {
-		AccessToken string `json:"accessToken"`
+// loadTikTokOptions reads TIKTOK_UID_SOURCE (open_id or union_id),
+// TIKTOK_PROFILE_FIELDS and TIKTOK_PROFILE_FIELDS_TARGET (token or user).
+func loadTikTokOptions() {
+	tikTok = tikTokOptions{
+		ProfileFields:        parseBoolEnv("TIKTOK_PROFILE_FIELDS"),
+		PersistProfileFields: parseRolesTarget("TIKTOK_PROFILE_FIELDS_TARGET"),
+	}
+	switch source := strings.ToLower(strings.TrimSpace(os.Getenv("TIKTOK_UID_SOURCE"))); source {
+	case "", "open_id":
+	case "union_id":
+		tikTok.UseUnionID = true
+	default:
+		log.Fatalf("FATAL: TIKTOK_UID_SOURCE must be open_id or union_id, got %q", source)
 	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+	if tikTok.UseUnionID || tikTok.ProfileFields {
+		log.Printf("INFO: Loaded TikTok options: %+v", tikTok)
 	}
+}
 
-	url := "https://open.tiktokapis.com/v2/user/info/?fields=open_id,avatar_url_100,display_name"
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
+func CreateTikTokFirebaseToken(w http.ResponseWriter, r *http.Request) {
+	createFirebaseToken(w, r, "tiktok")
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to verify TikTok token", http.StatusUnauthorized)
-		return
+type tikTokUserInfoFetcher struct{}
+
+func (tikTokUserInfoFetcher) FetchProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	fields := "open_id,union_id,avatar_url_100,display_name"
+	if tikTok.ProfileFields {
+		fields += ",username,bio_description,is_verified"
 	}
-	defer resp.Body.Close()
+	url := "https://open.tiktokapis.com/v2/user/info/?fields=" + fields
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
 
 	var responseData struct {
 		Data struct {
 			User TikTokUserInfo `json:"user"`
 		} `json:"data"`
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+			LogID   string `json:"log_id"`
+		} `json:"error"`
+	}
+	rawUserInfo, err := fetchUserInfo(req, client, "TikTok", &responseData)
+	if err != nil {
+		return ProviderProfile{}, err
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
-		http.Error(w, "Failed to parse TikTok user info", http.StatusInternalServerError)
-		return
+
+	// TikTok reports errors such as access_token_invalid in the body, even
+	// with HTTP 200.
+	if apiErr := responseData.Error; apiErr.Code != "" && apiErr.Code != "ok" {
+		return ProviderProfile{}, &requestError{
+			Status:  http.StatusUnauthorized,
+			Message: "Failed to verify TikTok token",
+			Err:     fmt.Errorf("TikTok API error %s: %s (log_id %s)", apiErr.Code, apiErr.Message, apiErr.LogID),
+		}
 	}
 
 	userInfo := responseData.Data.User
 	uid := userInfo.OpenID
-
-	_, err = firebaseAuthClient.GetUser(context.Background(), uid)
-
-	if err != nil {
-		if !auth.IsUserNotFound(err) {
-			http.Error(w, "Error looking up Firebase user", http.StatusInternalServerError)
-			return
-		}
-
-		params := (&auth.UserToCreate{}).
-			UID(uid).
-			DisplayName(userInfo.DisplayName).
-			PhotoURL(userInfo.AvatarURL)
-
-		userRecord, createErr := firebaseAuthClient.CreateUser(context.Background(), params)
-		if createErr != nil {
-			http.Error(w, "Failed to create new Firebase user", http.StatusInternalServerError)
-			return
+	if tikTok.UseUnionID {
+		if userInfo.UnionID == "" {
+			return ProviderProfile{}, &requestError{Status: http.StatusBadGateway, Message: "TikTok did not return a union_id"}
 		}
-		log.Printf("Successfully created new user via TikTok: %s\n", userRecord.UID)
+		uid = userInfo.UnionID
 	}
 
-	customToken, err := firebaseAuthClient.CustomToken(context.Background(), uid)
-	if err != nil {
-		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
-		return
+	profile := ProviderProfile{
+		Provider:    "tiktok",
+		UID:         uid,
+		DisplayName: userInfo.DisplayName,
+		PhotoURL:    userInfo.AvatarURL,
+		UserInfo:    objectAt(rawUserInfo, "data", "user"),
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"firebase_token": customToken})
+	if tikTok.ProfileFields {
+		target := &profile.Claims
+		if tikTok.PersistProfileFields {
+			target = &profile.UserClaims
+		}
+		*target = map[string]interface{}{"is_verified": userInfo.IsVerified}
+		if userInfo.Username != "" {
+			(*target)["username"] = userInfo.Username
+		}
+		if userInfo.BioDescription != "" {
+			(*target)["bio_description"] = userInfo.BioDescription
+		}
+	}
+	return profile, nil
 }
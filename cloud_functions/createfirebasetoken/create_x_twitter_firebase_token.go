@@ -2,11 +2,8 @@ package createfirebasetoken
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"net/http"
-
-	"firebase.google.com/go/v4/auth"
 )
 
 type XUserResponse struct {
@@ -18,77 +15,58 @@ type XUserInfo struct {
 	Name            string `json:"name"`
 	Username        string `json:"username"`
 	ProfileImageURL string `json:"profile_image_url"`
+	Verified        bool   `json:"verified"`
+	Description     string `json:"description"`
+	// ConfirmedEmail is only returned when requested and the app has the
+	// users.email permission.
+	ConfirmedEmail string `json:"confirmed_email"`
 }
 
-func CreateXTwitterFirebaseToken(w http.ResponseWriter, r *http.Request) {
-	setCorsHeaders(w, r)
-	if r.Method == http.MethodOptions {
-		w.WriteHeader(http.StatusNoContent)
-		return
-	}
-	if r.Method != http.MethodPost {
-		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// xRequestConfirmedEmail adds confirmed_email to the requested user fields.
+var xRequestConfirmedEmail bool
 
-	var reqBody struct {
-		AccessToken string `json:"accessToken"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
-		return
+// loadXOptions reads X_REQUEST_CONFIRMED_EMAIL.
+func loadXOptions() {
+	xRequestConfirmedEmail = parseBoolEnv("X_REQUEST_CONFIRMED_EMAIL")
+	if xRequestConfirmedEmail {
+		log.Println("INFO: Requesting confirmed emails from X.")
 	}
+}
 
-	url := "https://api.x.com/2/users/me?user.fields=profile_image_url"
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
+func CreateXTwitterFirebaseToken(w http.ResponseWriter, r *http.Request) {
+	createFirebaseToken(w, r, "x_twitter")
+}
+
+type xTwitterUserInfoFetcher struct{}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to verify X token", http.StatusUnauthorized)
-		return
+func (xTwitterUserInfoFetcher) FetchProfile(ctx context.Context, client *http.Client, reqBody TokenRequest) (ProviderProfile, error) {
+	url := "https://api.x.com/2/users/me?user.fields=profile_image_url,verified,description"
+	if xRequestConfirmedEmail {
+		url += ",confirmed_email"
 	}
-	defer resp.Body.Close()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req.Header.Add("Authorization", "Bearer "+reqBody.AccessToken)
 
 	var responseData XUserResponse
-	if err := json.NewDecoder(resp.Body).Decode(&responseData); err != nil {
-		http.Error(w, "Failed to parse X user info", http.StatusInternalServerError)
-		return
+	rawUserInfo, err := fetchUserInfo(req, client, "X", &responseData)
+	if err != nil {
+		return ProviderProfile{}, err
 	}
 
 	userInfo := responseData.Data
-	uid := userInfo.ID
 	displayName := userInfo.Name
 	if displayName == "" {
 		displayName = userInfo.Username
 	}
 
-	_, err = firebaseAuthClient.GetUser(context.Background(), uid)
-	if err != nil {
-		if !auth.IsUserNotFound(err) {
-			http.Error(w, "Error looking up Firebase user", http.StatusInternalServerError)
-			return
-		}
-		params := (&auth.UserToCreate{}).
-			UID(uid).
-			DisplayName(displayName).
-			PhotoURL(userInfo.ProfileImageURL)
-
-		userRecord, createErr := firebaseAuthClient.CreateUser(context.Background(), params)
-		if createErr != nil {
-			http.Error(w, "Failed to create new Firebase user", http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Successfully created new user via X: %s\n", userRecord.UID)
-	}
-
-	customToken, err := firebaseAuthClient.CustomToken(context.Background(), uid)
-	if err != nil {
-		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"firebase_token": customToken})
+	// X only returns addresses the user has confirmed.
+	return ProviderProfile{
+		Provider:      "x_twitter",
+		UID:           userInfo.ID,
+		Email:         userInfo.ConfirmedEmail,
+		EmailVerified: userInfo.ConfirmedEmail != "",
+		DisplayName:   displayName,
+		PhotoURL:      userInfo.ProfileImageURL,
+		UserInfo:      objectAt(rawUserInfo, "data"),
+	}, nil
 }
@@ -1,4 +1,7 @@
 $deployScriptsDir = $PSScriptRoot
+$firebaseTokenDeployScript = Join-Path $deployScriptsDir "deploy_create_firebase_token.ps1"
+$authCodeDeployScript = Join-Path $deployScriptsDir "deploy_sign_in_with_auth_code.ps1"
+$nonceDeployScript = Join-Path $deployScriptsDir "deploy_issue_nonce.ps1"
 $facebookDeployScript = Join-Path $deployScriptsDir "deploy_create_facebook_firebase_token.ps1"
 $githubDeployScript = Join-Path $deployScriptsDir "deploy_create_github_firebase_token.ps1"
 $googleDeployScript = Join-Path $deployScriptsDir "deploy_create_google_firebase_token.ps1"
@@ -7,6 +10,9 @@ $linkedinDeployScript = Join-Path $deployScriptsDir "deploy_create_linkedin_fire
 $microsoftDeployScript = Join-Path $deployScriptsDir "deploy_create_microsoft_firebase_token.ps1"
 $tiktokDeployScript = Join-Path $deployScriptsDir "deploy_create_tiktok_firebase_token.ps1"
 $xTwitterDeployScript = Join-Path $deployScriptsDir "deploy_create_x_twitter_firebase_token.ps1"
+& $firebaseTokenDeployScript
+& $authCodeDeployScript
+& $nonceDeployScript
 & $facebookDeployScript
 & $githubDeployScript
 & $googleDeployScript
@@ -0,0 +1,9 @@
+gcloud functions deploy create_firebase_token `
+  --source=".." `
+  --gen2 `
+  --runtime=go122 `
+  --region=us-central1 `
+  --entry-point=CreateFirebaseToken `
+  --trigger-http `
+  --allow-unauthenticated `
+  --env-vars-file "../../../../createfirebasetoken_env/env.yaml"
\ No newline at end of file
@@ -0,0 +1,102 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// EmailConflictPolicy decides what happens when a new user's email already
+// belongs to another Firebase user.
+type EmailConflictPolicy string
+
+const (
+	// EmailConflictError rejects the sign-in with an
+	// account-exists-with-different-credential error.
+	EmailConflictError EmailConflictPolicy = "error"
+	// EmailConflictLink signs the user into the existing account when both
+	// emails are verified, and rejects the sign-in otherwise.
+	EmailConflictLink EmailConflictPolicy = "link"
+	// EmailConflictCreateWithoutEmail creates the user without an email.
+	EmailConflictCreateWithoutEmail EmailConflictPolicy = "create_without_email"
+)
+
+const errCodeAccountExists = "account-exists-with-different-credential"
+
+var emailConflictPolicy EmailConflictPolicy
+
+// loadEmailConflictPolicy reads EMAIL_CONFLICT_POLICY, defaulting to
+// create_without_email.
+func loadEmailConflictPolicy() {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv("EMAIL_CONFLICT_POLICY")))
+	switch EmailConflictPolicy(value) {
+	case "":
+		emailConflictPolicy = EmailConflictCreateWithoutEmail
+	case EmailConflictError, EmailConflictLink, EmailConflictCreateWithoutEmail:
+		emailConflictPolicy = EmailConflictPolicy(value)
+	default:
+		log.Fatalf("FATAL: EMAIL_CONFLICT_POLICY must be one of error, link or create_without_email, got %q", value)
+	}
+	log.Printf("INFO: Loaded email conflict policy: %s", emailConflictPolicy)
+}
+
+// resolveEmailConflict applies the email conflict policy after CreateUser
+// failed because profile.Email is taken. It returns the user to sign in and
+// the fields that were written.
+func resolveEmailConflict(ctx context.Context, profile ProviderProfile, setFields []string) (*auth.UserRecord, []string, error) {
+	if emailConflictPolicy == EmailConflictCreateWithoutEmail {
+		log.Printf("Warning: email of %s user %s is already in use, creating without it.", profile.Provider, profile.UID)
+		setFields = withoutField(setFields, fieldEmail)
+		user, err := firebaseAuthClient.CreateUser(ctx, userToCreate(profile, setFields))
+		if err != nil && auth.IsUIDAlreadyExists(err) {
+			return rereadCreatedUser(ctx, profile)
+		}
+		if err != nil {
+			return nil, nil, &requestError{Status: http.StatusInternalServerError, Message: "Failed to create new Firebase user", Err: err}
+		}
+		log.Printf("Successfully created new user via %s: %s (fields: %v)\n", profile.Provider, user.UID, setFields)
+		return user, setFields, nil
+	}
+
+	existing, err := firebaseAuthClient.GetUserByEmail(ctx, profile.Email)
+	if err != nil {
+		return nil, nil, &requestError{Status: http.StatusInternalServerError, Message: "Error looking up Firebase user", Err: err}
+	}
+
+	if emailConflictPolicy == EmailConflictLink && profile.EmailVerified && existing.EmailVerified {
+		// The existing account belongs to another sign-in method, so its
+		// profile is left as it is rather than synced from this provider.
+		log.Printf("Linking %s user %s to existing user %s by verified email.", profile.Provider, profile.UID, existing.UID)
+		if err := checkUserRecord(existing); err != nil {
+			return nil, nil, err
+		}
+		return existing, []string{}, nil
+	}
+
+	return nil, nil, &requestError{
+		Status:  http.StatusConflict,
+		Code:    errCodeAccountExists,
+		Message: "An account already exists with the same email address but different sign-in credentials.",
+		Details: map[string]interface{}{
+			"email":           profile.Email,
+			"sign_in_methods": signInMethods(existing),
+		},
+	}
+}
+
+// signInMethods lists the provider IDs linked to user. Users minted through
+// these functions have no linked providers and are reported as "custom".
+func signInMethods(user *auth.UserRecord) []string {
+	methods := []string{}
+	for _, info := range user.ProviderUserInfo {
+		methods = append(methods, info.ProviderID)
+	}
+	if len(methods) == 0 {
+		methods = append(methods, "custom")
+	}
+	return methods
+}
@@ -0,0 +1,105 @@
+package createfirebasetoken
+
+import (
+	_ "embed"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//go:embed disposable_email_domains.txt
+var disposableEmailDomainsList string
+
+// emailSignUpPolicy restricts which emails may create a new Firebase user.
+type emailSignUpPolicy struct {
+	// Providers are the providers the policy applies to.
+	Providers map[string]bool
+	// AllowedDomains, when set, are the only email domains that may sign up.
+	// Only verified emails match them.
+	AllowedDomains map[string]bool
+	// DeniedDomains may never sign up.
+	DeniedDomains map[string]bool
+	// BlockDisposable denies the bundled list of disposable email domains.
+	BlockDisposable bool
+	// RequireVerifiedEmail denies sign-ups without a verified email.
+	RequireVerifiedEmail bool
+}
+
+var emailPolicy emailSignUpPolicy
+
+var disposableEmailDomains map[string]bool
+
+// loadEmailSignUpPolicy reads EMAIL_POLICY_PROVIDERS, EMAIL_DOMAIN_ALLOWLIST,
+// EMAIL_DOMAIN_DENYLIST, BLOCK_DISPOSABLE_EMAIL_DOMAINS and
+// REQUIRE_VERIFIED_EMAIL_FOR_SIGN_UP.
+func loadEmailSignUpPolicy() {
+	providers := os.Getenv("EMAIL_POLICY_PROVIDERS")
+	if providers == "" {
+		providers = "facebook,github,google,linkedin,microsoft,x_twitter"
+	}
+	emailPolicy = emailSignUpPolicy{
+		Providers:            parseLowerSet(providers),
+		AllowedDomains:       parseLowerSet(os.Getenv("EMAIL_DOMAIN_ALLOWLIST")),
+		DeniedDomains:        parseLowerSet(os.Getenv("EMAIL_DOMAIN_DENYLIST")),
+		BlockDisposable:      parseBoolEnv("BLOCK_DISPOSABLE_EMAIL_DOMAINS"),
+		RequireVerifiedEmail: parseBoolEnv("REQUIRE_VERIFIED_EMAIL_FOR_SIGN_UP"),
+	}
+
+	disposableEmailDomains = map[string]bool{}
+	for _, line := range strings.Split(disposableEmailDomainsList, "\n") {
+		if line = strings.ToLower(strings.TrimSpace(line)); line != "" && !strings.HasPrefix(line, "#") {
+			disposableEmailDomains[line] = true
+		}
+	}
+	log.Printf("INFO: Loaded email sign-up policy: %+v", emailPolicy)
+}
+
+// checkEmailSignUpPolicy returns an error when profile may not create a new
+// Firebase user.
+func checkEmailSignUpPolicy(profile ProviderProfile) error {
+	if !emailPolicy.Providers[profile.Provider] {
+		return nil
+	}
+
+	if emailPolicy.RequireVerifiedEmail && (profile.Email == "" || !profile.EmailVerified) {
+		return emailPolicyError(profile, "email-not-verified", "A verified email address is required to sign up.")
+	}
+
+	domain := ""
+	if at := strings.LastIndex(profile.Email, "@"); at >= 0 {
+		domain = strings.ToLower(profile.Email[at+1:])
+	}
+	// An unverified email can be set to any address by whoever controls the
+	// provider account, so it never proves membership of an allowed domain.
+	if len(emailPolicy.AllowedDomains) > 0 && (!profile.EmailVerified || !domainInSet(domain, emailPolicy.AllowedDomains)) {
+		return emailPolicyError(profile, "email-domain-not-allowed", "Sign-ups from this email domain are not allowed.")
+	}
+	if domain != "" && domainInSet(domain, emailPolicy.DeniedDomains) {
+		return emailPolicyError(profile, "email-domain-not-allowed", "Sign-ups from this email domain are not allowed.")
+	}
+	if domain != "" && emailPolicy.BlockDisposable && domainInSet(domain, disposableEmailDomains) {
+		return emailPolicyError(profile, "email-domain-disposable", "Sign-ups from disposable email addresses are not allowed.")
+	}
+	return nil
+}
+
+// domainInSet reports whether domain or one of its parent domains is in set.
+func domainInSet(domain string, set map[string]bool) bool {
+	for domain != "" {
+		if set[domain] {
+			return true
+		}
+		dot := strings.Index(domain, ".")
+		if dot < 0 {
+			return false
+		}
+		domain = domain[dot+1:]
+	}
+	return false
+}
+
+func emailPolicyError(profile ProviderProfile, code, message string) error {
+	log.Printf("Rejected sign-up of %s user %s: %s", profile.Provider, profile.UID, code)
+	return &requestError{Status: http.StatusForbidden, Code: code, Message: message}
+}
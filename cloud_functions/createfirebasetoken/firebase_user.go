@@ -0,0 +1,408 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// ProviderProfile is the normalized profile each handler builds from its
+// provider's userinfo response before handing it to the shared sign-in code.
+type ProviderProfile struct {
+	Provider      string
+	UID           string
+	Email         string
+	EmailVerified bool
+	DisplayName   string
+	PhotoURL      string
+
+	// UserInfo is the provider's raw userinfo payload, used by the claim
+	// mappings.
+	UserInfo map[string]interface{}
+	// Claims are added to the minted token on top of the configured mappings.
+	Claims map[string]interface{}
+	// UserClaims are merged into the user's persistent custom claims.
+	UserClaims map[string]interface{}
+}
+
+// decodeUserInfo decodes a provider's userinfo response into v and also
+// returns it as a generic map for ProviderProfile.UserInfo.
+func decodeUserInfo(body io.Reader, v interface{}) (map[string]interface{}, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// objectAt walks keys into a decoded JSON object and returns the nested
+// object, or nil when the path does not lead to one.
+func objectAt(raw map[string]interface{}, keys ...string) map[string]interface{} {
+	object := raw
+	for _, key := range keys {
+		next, ok := object[key].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		object = next
+	}
+	return object
+}
+
+// requestError is returned by the shared sign-in helpers so the handler can
+// answer with the right status and message. Errors with a Code are written as
+// a JSON body the client can act on; Details are added to that body.
+type requestError struct {
+	Status  int
+	Code    string
+	Message string
+	Details map[string]interface{}
+	Err     error
+}
+
+func (e *requestError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *requestError) Unwrap() error {
+	return e.Err
+}
+
+// writeRequestError writes err to w, falling back to a generic 500 for errors
+// that are not a *requestError.
+func writeRequestError(w http.ResponseWriter, err error) {
+	reqErr, ok := err.(*requestError)
+	if !ok {
+		reqErr = &requestError{Status: http.StatusInternalServerError, Message: "Internal error", Err: err}
+	}
+	if reqErr.Err != nil {
+		log.Printf("Error: %v", reqErr)
+	}
+	if reqErr.Code == "" {
+		http.Error(w, reqErr.Message, reqErr.Status)
+		return
+	}
+
+	body := map[string]interface{}{
+		"code":    reqErr.Code,
+		"message": reqErr.Message,
+	}
+	for key, value := range reqErr.Details {
+		body[key] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(reqErr.Status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": body})
+}
+
+// signInWithProfile gets or creates the Firebase user described by profile,
+// mints a custom token carrying the configured claims and writes the token
+// response.
+func signInWithProfile(w http.ResponseWriter, profile ProviderProfile) {
+	ctx := context.Background()
+
+	if err := checkBlockedSubject(profile); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	user, updatedFields, err := getOrCreateFirebaseUser(ctx, &profile)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	overridden, err := runHook(ctx, hookBeforeSignIn, &profile)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+	if len(overridden) > 0 {
+		var overriddenFields []string
+		user, overriddenFields = applyHookOverrides(ctx, user, profile, overridden)
+		updatedFields = mergeFields(updatedFields, overriddenFields)
+	}
+
+	if err := applyUserClaims(ctx, user, profile.UserClaims); err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	claims := buildCustomClaims(profile)
+	if err := validateCustomClaims(claims); err != nil {
+		log.Printf("Error: refusing to mint token for %s: %v", user.UID, err)
+		http.Error(w, "Failed to create Firebase custom token: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	customToken, err := firebaseAuthClient.CustomTokenWithClaims(ctx, user.UID, claims)
+	if err != nil {
+		http.Error(w, "Failed to create Firebase custom token", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"firebase_token": customToken,
+		"updated_fields": updatedFields,
+	})
+}
+
+// userLookup is an in-flight get-or-create call that concurrent sign-ins of
+// the same UID wait on instead of racing it.
+type userLookup struct {
+	done       chan struct{}
+	user       *auth.UserRecord
+	fields     []string
+	hookClaims map[string]interface{}
+	err        error
+	// joined counts the callers waiting on the lookup. It is guarded by
+	// userLookupsMu.
+	joined int
+}
+
+var (
+	userLookupsMu sync.Mutex
+	userLookups   = map[string]*userLookup{}
+)
+
+// getOrCreateFirebaseUser returns the Firebase user for profile.UID, creating
+// it when missing. The profile sync policy decides which fields are written,
+// and the names of the fields that were written are returned. When the email
+// conflict policy links the profile to an existing account, that account's
+// record is returned instead.
+//
+// Concurrent calls for the same UID within this instance share one lookup.
+// Callers that joined it keep their own profile, plus the claims the
+// before_create hook added, and get their own copy of the user and fields.
+func getOrCreateFirebaseUser(ctx context.Context, profile *ProviderProfile) (*auth.UserRecord, []string, error) {
+	userLookupsMu.Lock()
+	if lookup, ok := userLookups[profile.UID]; ok {
+		lookup.joined++
+		userLookupsMu.Unlock()
+		<-lookup.done
+		if lookup.err != nil {
+			return nil, nil, lookup.err
+		}
+		addClaims(profile, lookup.hookClaims)
+		user := *lookup.user
+		return &user, slices.Clone(lookup.fields), nil
+	}
+	lookup := &userLookup{done: make(chan struct{})}
+	userLookups[profile.UID] = lookup
+	userLookupsMu.Unlock()
+
+	lookup.user, lookup.fields, lookup.hookClaims, lookup.err = lookUpOrCreateFirebaseUser(ctx, profile)
+
+	userLookupsMu.Lock()
+	delete(userLookups, profile.UID)
+	userLookupsMu.Unlock()
+	close(lookup.done)
+
+	return lookup.user, lookup.fields, lookup.err
+}
+
+// lookUpOrCreateFirebaseUser also returns the claims the before_create hook
+// added to profile, if the user was created.
+func lookUpOrCreateFirebaseUser(ctx context.Context, profile *ProviderProfile) (*auth.UserRecord, []string, map[string]interface{}, error) {
+	user, err := firebaseAuthClient.GetUser(ctx, profile.UID)
+	if err != nil {
+		if !auth.IsUserNotFound(err) {
+			return nil, nil, nil, &requestError{Status: http.StatusInternalServerError, Message: "Error looking up Firebase user", Err: err}
+		}
+		return createFirebaseUser(ctx, profile)
+	}
+	user, fields, err := signInExistingUser(ctx, user, *profile)
+	return user, fields, nil, err
+}
+
+// signInExistingUser applies the post-lookup policy and profile sync to a
+// user that already exists.
+func signInExistingUser(ctx context.Context, user *auth.UserRecord, profile ProviderProfile) (*auth.UserRecord, []string, error) {
+	if err := checkUserRecord(user); err != nil {
+		return nil, nil, err
+	}
+	return syncFirebaseUser(ctx, user, profile)
+}
+
+// rereadCreatedUser handles CreateUser failing with "uid already exists":
+// another instance created the user in the meantime, so the sign-in goes on
+// with that user.
+func rereadCreatedUser(ctx context.Context, profile ProviderProfile) (*auth.UserRecord, []string, error) {
+	log.Printf("User %s was created concurrently, re-reading it.", profile.UID)
+	user, err := firebaseAuthClient.GetUser(ctx, profile.UID)
+	if err != nil {
+		return nil, nil, &requestError{Status: http.StatusInternalServerError, Message: "Error looking up Firebase user", Err: err}
+	}
+	return signInExistingUser(ctx, user, profile)
+}
+
+// createFirebaseUser creates the user after the sign-up policy and the
+// before_create hook allowed it. The hook may change profile; the claims it
+// added are returned as well.
+func createFirebaseUser(ctx context.Context, profile *ProviderProfile) (*auth.UserRecord, []string, map[string]interface{}, error) {
+	if err := checkEmailSignUpPolicy(*profile); err != nil {
+		return nil, nil, nil, err
+	}
+	// The hook runs on a copy without claims, so the ones it adds can be
+	// told apart from the provider's.
+	hooked := *profile
+	hooked.Claims = nil
+	if _, err := runHook(ctx, hookBeforeCreate, &hooked); err != nil {
+		return nil, nil, nil, err
+	}
+	hookClaims := hooked.Claims
+	hooked.Claims = profile.Claims
+	*profile = hooked
+	addClaims(profile, hookClaims)
+
+	user, fields, err := insertFirebaseUser(ctx, *profile)
+	return user, fields, hookClaims, err
+}
+
+// insertFirebaseUser creates the user with the fields the profile sync policy
+// writes on creation.
+func insertFirebaseUser(ctx context.Context, profile ProviderProfile) (*auth.UserRecord, []string, error) {
+	setFields := []string{}
+	if profile.DisplayName != "" && profileSyncPolicy.DisplayName.writesOnCreate() {
+		setFields = append(setFields, fieldDisplayName)
+	}
+	if profile.PhotoURL != "" && profileSyncPolicy.PhotoURL.writesOnCreate() {
+		setFields = append(setFields, fieldPhotoURL)
+	}
+	if profile.Email != "" && profileSyncPolicy.Email.writesOnCreate() {
+		setFields = append(setFields, fieldEmail)
+	}
+
+	user, err := firebaseAuthClient.CreateUser(ctx, userToCreate(profile, setFields))
+	if err != nil && auth.IsUIDAlreadyExists(err) {
+		return rereadCreatedUser(ctx, profile)
+	}
+	if err != nil && auth.IsEmailAlreadyExists(err) {
+		return resolveEmailConflict(ctx, profile, setFields)
+	}
+	if err != nil {
+		return nil, nil, &requestError{Status: http.StatusInternalServerError, Message: "Failed to create new Firebase user", Err: err}
+	}
+	log.Printf("Successfully created new user via %s: %s (fields: %v)\n", profile.Provider, user.UID, setFields)
+	return user, setFields, nil
+}
+
+// syncFirebaseUser refreshes the fields of an existing user whose sync mode is
+// "always" and whose value changed at the provider. With email sync
+// "backfill", a verified email is also written onto users that have none, or
+// have it unverified. A failed update is logged but does not block the sign-in.
+func syncFirebaseUser(ctx context.Context, user *auth.UserRecord, profile ProviderProfile) (*auth.UserRecord, []string, error) {
+	changedFields := []string{}
+	if profile.DisplayName != "" && profileSyncPolicy.DisplayName.writesOnSignIn() && profile.DisplayName != user.DisplayName {
+		changedFields = append(changedFields, fieldDisplayName)
+	}
+	if profile.PhotoURL != "" && profileSyncPolicy.PhotoURL.writesOnSignIn() && profile.PhotoURL != user.PhotoURL {
+		changedFields = append(changedFields, fieldPhotoURL)
+	}
+	if profile.Email != "" && emailNeedsSync(user, profile) {
+		changedFields = append(changedFields, fieldEmail)
+	}
+
+	if len(changedFields) == 0 {
+		log.Printf("User %s already exists, profile unchanged.", user.UID)
+		return user, changedFields, nil
+	}
+
+	updated, err := firebaseAuthClient.UpdateUser(ctx, user.UID, userToUpdate(profile, changedFields))
+	if err != nil && auth.IsEmailAlreadyExists(err) {
+		log.Printf("Warning: email of %s user %s is already in use, updating without it.", profile.Provider, user.UID)
+		changedFields = withoutField(changedFields, fieldEmail)
+		if len(changedFields) == 0 {
+			return user, changedFields, nil
+		}
+		updated, err = firebaseAuthClient.UpdateUser(ctx, user.UID, userToUpdate(profile, changedFields))
+	}
+	if err != nil {
+		log.Printf("Warning: failed to update user %s: %v", user.UID, err)
+		return user, []string{}, nil
+	}
+	log.Printf("User %s already exists, updated fields: %v", user.UID, changedFields)
+	return updated, changedFields, nil
+}
+
+func emailNeedsSync(user *auth.UserRecord, profile ProviderProfile) bool {
+	switch profileSyncPolicy.Email {
+	case ProfileSyncAlways:
+		return profile.Email != user.Email || profile.EmailVerified != user.EmailVerified
+	case ProfileSyncBackfill:
+		if !profile.EmailVerified {
+			return false
+		}
+		return user.Email == "" || (strings.EqualFold(user.Email, profile.Email) && !user.EmailVerified)
+	default:
+		return false
+	}
+}
+
+func userToCreate(profile ProviderProfile, fields []string) *auth.UserToCreate {
+	params := (&auth.UserToCreate{}).UID(profile.UID)
+	for _, field := range fields {
+		switch field {
+		case fieldDisplayName:
+			params.DisplayName(profile.DisplayName)
+		case fieldPhotoURL:
+			params.PhotoURL(profile.PhotoURL)
+		case fieldEmail:
+			params.Email(profile.Email).EmailVerified(profile.EmailVerified)
+		}
+	}
+	return params
+}
+
+func userToUpdate(profile ProviderProfile, fields []string) *auth.UserToUpdate {
+	params := &auth.UserToUpdate{}
+	for _, field := range fields {
+		switch field {
+		case fieldDisplayName:
+			params.DisplayName(profile.DisplayName)
+		case fieldPhotoURL:
+			params.PhotoURL(profile.PhotoURL)
+		case fieldEmail:
+			params.Email(profile.Email).EmailVerified(profile.EmailVerified)
+		}
+	}
+	return params
+}
+
+// mergeFields appends the entries of extra missing from fields.
+func mergeFields(fields, extra []string) []string {
+	for _, field := range extra {
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func withoutField(fields []string, field string) []string {
+	kept := []string{}
+	for _, f := range fields {
+		if f != field {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
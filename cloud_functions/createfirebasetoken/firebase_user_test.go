@@ -0,0 +1,219 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/auth"
+)
+
+// fakeAuthClient answers the calls the tests expect; any other call panics on
+// the nil embedded interface.
+type fakeAuthClient struct {
+	authClient
+	getUser             func(ctx context.Context, uid string) (*auth.UserRecord, error)
+	createUser          func(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error)
+	setCustomUserClaims func(ctx context.Context, uid string, claims map[string]interface{}) error
+}
+
+func (f *fakeAuthClient) GetUser(ctx context.Context, uid string) (*auth.UserRecord, error) {
+	return f.getUser(ctx, uid)
+}
+
+func (f *fakeAuthClient) CreateUser(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error) {
+	return f.createUser(ctx, user)
+}
+
+func (f *fakeAuthClient) SetCustomUserClaims(ctx context.Context, uid string, claims map[string]interface{}) error {
+	return f.setCustomUserClaims(ctx, uid, claims)
+}
+
+func useAuthClient(t *testing.T, client authClient) {
+	previous := firebaseAuthClient
+	firebaseAuthClient = client
+	t.Cleanup(func() { firebaseAuthClient = previous })
+}
+
+// authBackendError returns the error the Firebase Auth client reports when the
+// backend answers with code, such as USER_NOT_FOUND, so the fake fails the
+// same way the real client does.
+func authBackendError(t *testing.T, code string) error {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"error":{"message":%q}}`, code)
+	}))
+	defer server.Close()
+	t.Setenv("FIREBASE_AUTH_EMULATOR_HOST", strings.TrimPrefix(server.URL, "http://"))
+
+	ctx := context.Background()
+	app, err := firebase.NewApp(ctx, &firebase.Config{ProjectID: "test-project"})
+	if err != nil {
+		t.Fatalf("NewApp: %v", err)
+	}
+	client, err := app.Auth(ctx)
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	_, err = client.GetUser(ctx, "test-uid")
+	if err == nil {
+		t.Fatalf("GetUser against a failing backend returned no error")
+	}
+	return err
+}
+
+func userRecord(uid string) *auth.UserRecord {
+	return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: uid}, CustomClaims: map[string]interface{}{}}
+}
+
+// waitForJoined polls until n callers wait on the in-flight lookup of uid.
+func waitForJoined(t *testing.T, uid string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		userLookupsMu.Lock()
+		joined := 0
+		if lookup, ok := userLookups[uid]; ok {
+			joined = lookup.joined
+		}
+		userLookupsMu.Unlock()
+		if joined >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d of %d callers joined the lookup of %s", joined, n, uid)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGetOrCreateFirebaseUserSharesConcurrentLookups(t *testing.T) {
+	notFound := authBackendError(t, "USER_NOT_FOUND")
+
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"action":"allow","claims":{"tenant":"acme"}}`)
+	}))
+	defer hookServer.Close()
+	previousHooks, previousSync := hooks, profileSyncPolicy
+	hooks = hookConfig{BeforeCreateURL: hookServer.URL, Secret: "test-secret", Timeout: 5 * time.Second}
+	profileSyncPolicy = ProfileSyncPolicy{DisplayName: ProfileSyncOnCreate}
+	t.Cleanup(func() { hooks, profileSyncPolicy = previousHooks, previousSync })
+
+	var lookups, creates atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	useAuthClient(t, &fakeAuthClient{
+		getUser: func(ctx context.Context, uid string) (*auth.UserRecord, error) {
+			if lookups.Add(1) == 1 {
+				close(started)
+			}
+			<-release
+			return nil, notFound
+		},
+		createUser: func(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			creates.Add(1)
+			return userRecord("github:42"), nil
+		},
+		setCustomUserClaims: func(ctx context.Context, uid string, claims map[string]interface{}) error {
+			return nil
+		},
+	})
+
+	// signIn runs the part of signInWithProfile that uses the user and fields.
+	type result struct {
+		err     error
+		user    *auth.UserRecord
+		profile ProviderProfile
+		want    string
+	}
+	const waiters = 4
+	results := make(chan result, waiters+1)
+	signIn := func(name string) {
+		profile := ProviderProfile{
+			Provider:    "github",
+			UID:         "github:42",
+			DisplayName: name,
+			UserClaims:  map[string]interface{}{"roles": []string{name}},
+		}
+		user, fields, err := getOrCreateFirebaseUser(context.Background(), &profile)
+		if err == nil {
+			err = applyUserClaims(context.Background(), user, profile.UserClaims)
+			mergeFields(fields, []string{fieldPhotoURL})
+		}
+		results <- result{err, user, profile, name}
+	}
+
+	go signIn("first")
+	<-started
+	for i := 0; i < waiters; i++ {
+		go signIn(fmt.Sprintf("waiter %d", i))
+	}
+	waitForJoined(t, "github:42", waiters)
+	close(release)
+
+	for i := 0; i < waiters+1; i++ {
+		r := <-results
+		if r.err != nil {
+			t.Fatalf("sign-in of %q: %v", r.want, r.err)
+		}
+		if r.user == nil || r.user.UID != "github:42" {
+			t.Errorf("got user %+v, want github:42", r.user)
+		}
+		if r.profile.DisplayName != r.want {
+			t.Errorf("profile display name is %q, want the caller's own %q", r.profile.DisplayName, r.want)
+		}
+		if r.profile.Claims["tenant"] != "acme" {
+			t.Errorf("%q did not get the before_create hook's claims: %v", r.want, r.profile.Claims)
+		}
+	}
+	if got := lookups.Load(); got != 1 {
+		t.Errorf("GetUser called %d times, want 1", got)
+	}
+	if got := creates.Load(); got != 1 {
+		t.Errorf("CreateUser called %d times, want 1", got)
+	}
+}
+func TestGetOrCreateFirebaseUserRereadsUserCreatedConcurrently(t *testing.T) {
+	notFound := authBackendError(t, "USER_NOT_FOUND")
+	alreadyExists := authBackendError(t, "DUPLICATE_LOCAL_ID")
+	if !auth.IsUIDAlreadyExists(alreadyExists) {
+		t.Fatalf("DUPLICATE_LOCAL_ID error is not recognized: %v", alreadyExists)
+	}
+
+	var lookups atomic.Int32
+	useAuthClient(t, &fakeAuthClient{
+		getUser: func(ctx context.Context, uid string) (*auth.UserRecord, error) {
+			if lookups.Add(1) == 1 {
+				return nil, notFound
+			}
+			return userRecord(uid), nil
+		},
+		createUser: func(ctx context.Context, user *auth.UserToCreate) (*auth.UserRecord, error) {
+			return nil, alreadyExists
+		},
+	})
+
+	profile := ProviderProfile{Provider: "github", UID: "github:42"}
+	user, fields, err := getOrCreateFirebaseUser(context.Background(), &profile)
+	if err != nil {
+		t.Fatalf("getOrCreateFirebaseUser: %v", err)
+	}
+	if user == nil || user.UID != "github:42" {
+		t.Errorf("got user %+v, want github:42", user)
+	}
+	if len(fields) != 0 {
+		t.Errorf("got updated fields %v, want none", fields)
+	}
+	if got := lookups.Load(); got != 2 {
+		t.Errorf("GetUser called %d times, want 2", got)
+	}
+}
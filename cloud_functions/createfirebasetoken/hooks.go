@@ -0,0 +1,210 @@
+package createfirebasetoken
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/auth"
+)
+
+// Blocking hook events, modelled on Identity Platform blocking functions.
+const (
+	hookBeforeCreate = "before_create"
+	hookBeforeSignIn = "before_sign_in"
+)
+
+// hookConfig describes the blocking webhooks called during sign-in.
+type hookConfig struct {
+	BeforeCreateURL string
+	BeforeSignInURL string
+	Secret          string
+	Timeout         time.Duration
+	// FailOpen lets sign-ins through when a hook cannot be reached or
+	// answers with an invalid response.
+	FailOpen bool
+}
+
+var hooks hookConfig
+
+// hookRequest is the JSON body POSTed to a hook.
+type hookRequest struct {
+	EventType     string                 `json:"event_type"`
+	Provider      string                 `json:"provider"`
+	UID           string                 `json:"uid"`
+	Email         string                 `json:"email,omitempty"`
+	EmailVerified bool                   `json:"email_verified"`
+	DisplayName   string                 `json:"display_name,omitempty"`
+	PhotoURL      string                 `json:"photo_url,omitempty"`
+	UserInfo      map[string]interface{} `json:"user_info,omitempty"`
+}
+
+// hookResponse is the JSON body a hook answers with. Action is "allow" or
+// "deny"; Claims are added to the minted token and Profile overrides the
+// provider's display name and photo.
+type hookResponse struct {
+	Action  string                 `json:"action"`
+	Message string                 `json:"message"`
+	Claims  map[string]interface{} `json:"claims"`
+	Profile struct {
+		DisplayName *string `json:"display_name"`
+		PhotoURL    *string `json:"photo_url"`
+	} `json:"profile"`
+}
+
+// loadHookConfig reads BEFORE_CREATE_HOOK_URL, BEFORE_SIGN_IN_HOOK_URL,
+// HOOK_SECRET, HOOK_TIMEOUT and HOOK_FAIL_OPEN.
+func loadHookConfig() {
+	hooks = hookConfig{
+		BeforeCreateURL: strings.TrimSpace(os.Getenv("BEFORE_CREATE_HOOK_URL")),
+		BeforeSignInURL: strings.TrimSpace(os.Getenv("BEFORE_SIGN_IN_HOOK_URL")),
+		Secret:          os.Getenv("HOOK_SECRET"),
+		Timeout:         5 * time.Second,
+		FailOpen:        parseBoolEnv("HOOK_FAIL_OPEN"),
+	}
+	if hooks.BeforeCreateURL == "" && hooks.BeforeSignInURL == "" {
+		return
+	}
+	if hooks.Secret == "" {
+		log.Fatal("FATAL: HOOK_SECRET must be set when a blocking hook URL is configured!")
+	}
+	if timeoutStr := strings.TrimSpace(os.Getenv("HOOK_TIMEOUT")); timeoutStr != "" {
+		timeout, err := time.ParseDuration(timeoutStr)
+		if err != nil || timeout <= 0 {
+			log.Fatalf("FATAL: HOOK_TIMEOUT must be a positive duration such as 5s, got %q", timeoutStr)
+		}
+		hooks.Timeout = timeout
+	}
+	log.Printf("INFO: Loaded blocking hooks: before_create=%q before_sign_in=%q timeout=%s fail_open=%t",
+		hooks.BeforeCreateURL, hooks.BeforeSignInURL, hooks.Timeout, hooks.FailOpen)
+}
+
+// runHook calls the hook for event, if one is configured, and applies its
+// answer to profile. It returns the profile fields the hook overrode, or an
+// error when the hook denied the sign-in or failed under fail-closed.
+func runHook(ctx context.Context, event string, profile *ProviderProfile) ([]string, error) {
+	url := hooks.BeforeCreateURL
+	if event == hookBeforeSignIn {
+		url = hooks.BeforeSignInURL
+	}
+	if url == "" {
+		return nil, nil
+	}
+
+	answer, err := callHook(ctx, url, event, *profile)
+	if err != nil {
+		if hooks.FailOpen {
+			log.Printf("Warning: %s hook failed, allowing %s user %s: %v", event, profile.Provider, profile.UID, err)
+			return nil, nil
+		}
+		return nil, &requestError{
+			Status:  http.StatusServiceUnavailable,
+			Code:    "hook-unavailable",
+			Message: "Sign-in is temporarily unavailable.",
+			Err:     fmt.Errorf("%s hook: %w", event, err),
+		}
+	}
+
+	if answer.Action == "deny" {
+		message := answer.Message
+		if message == "" {
+			message = "Sign-in was blocked."
+		}
+		log.Printf("Rejected %s user %s: denied by %s hook.", profile.Provider, profile.UID, event)
+		return nil, &requestError{Status: http.StatusForbidden, Code: "blocked-by-hook", Message: message}
+	}
+
+	addClaims(profile, answer.Claims)
+	overridden := []string{}
+	if answer.Profile.DisplayName != nil {
+		profile.DisplayName = *answer.Profile.DisplayName
+		overridden = append(overridden, fieldDisplayName)
+	}
+	if answer.Profile.PhotoURL != nil {
+		profile.PhotoURL = *answer.Profile.PhotoURL
+		overridden = append(overridden, fieldPhotoURL)
+	}
+	return overridden, nil
+}
+
+// callHook POSTs the profile to url, signed with HOOK_SECRET, and decodes the
+// answer. The X-Hook-Signature header carries an HMAC-SHA256 over
+// "<timestamp>.<body>" so the receiver can reject forged or replayed calls.
+func callHook(ctx context.Context, url, event string, profile ProviderProfile) (*hookResponse, error) {
+	body, err := json.Marshal(hookRequest{
+		EventType:     event,
+		Provider:      profile.Provider,
+		UID:           profile.UID,
+		Email:         profile.Email,
+		EmailVerified: profile.EmailVerified,
+		DisplayName:   profile.DisplayName,
+		PhotoURL:      profile.PhotoURL,
+		UserInfo:      profile.UserInfo,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hooks.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(hooks.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Hook-Signature", "t="+timestamp+",v1="+hex.EncodeToString(mac.Sum(nil)))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("hook returned non-OK status: %d", resp.StatusCode)
+	}
+	var answer hookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, err
+	}
+	if answer.Action != "allow" && answer.Action != "deny" {
+		return nil, fmt.Errorf("hook returned unknown action %q", answer.Action)
+	}
+	return &answer, nil
+}
+
+// applyHookOverrides writes the fields a before_sign_in hook overrode onto an
+// existing user, ignoring the profile sync policy.
+func applyHookOverrides(ctx context.Context, user *auth.UserRecord, profile ProviderProfile, overridden []string) (*auth.UserRecord, []string) {
+	changedFields := []string{}
+	for _, field := range overridden {
+		if (field == fieldDisplayName && profile.DisplayName != user.DisplayName) ||
+			(field == fieldPhotoURL && profile.PhotoURL != user.PhotoURL) {
+			changedFields = append(changedFields, field)
+		}
+	}
+	if len(changedFields) == 0 {
+		return user, changedFields
+	}
+	updated, err := firebaseAuthClient.UpdateUser(ctx, user.UID, userToUpdate(profile, changedFields))
+	if err != nil {
+		log.Printf("Warning: failed to apply hook overrides to user %s: %v", user.UID, err)
+		return user, []string{}
+	}
+	return updated, changedFields
+}
@@ -0,0 +1,303 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultJWKSMaxAge is how long keys are cached when the JWKS response has
+	// no Cache-Control max-age.
+	defaultJWKSMaxAge = time.Hour
+	// minJWKSRefreshInterval limits how often an unknown key ID triggers a
+	// refetch, so forged kids cannot hammer the provider.
+	minJWKSRefreshInterval = time.Minute
+	// jwtClockSkew is the tolerance applied to exp, nbf and iat.
+	jwtClockSkew = 2 * time.Minute
+)
+
+// jwksCache fetches a JSON Web Key Set and keeps its RSA keys in memory until
+// they expire, so ID tokens can be verified without a network round trip.
+type jwksCache struct {
+	url string
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+	expires time.Time
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url}
+}
+
+// key returns the public key with the given key ID, refreshing the cache when
+// it expired or when the kid is unknown, which is how key rotation shows up.
+// When a refresh fails, the keys already cached stay in use and the next
+// attempt waits minJWKSRefreshInterval, so a JWKS outage does not block
+// sign-ins.
+func (c *jwksCache) key(ctx context.Context, client *http.Client, kid string) (*rsa.PublicKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, known := c.keys[kid]
+	stale := c.keys == nil || time.Now().After(c.expires)
+	if stale || (!known && time.Since(c.fetched) > minJWKSRefreshInterval) {
+		if err := c.refresh(ctx, client); err != nil {
+			if c.keys == nil {
+				return nil, err
+			}
+			log.Printf("Warning: failed to refresh %s, using the cached keys: %v", c.url, err)
+			c.fetched = time.Now()
+			c.expires = c.fetched.Add(minJWKSRefreshInterval)
+		}
+	}
+	key, ok := c.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no key with kid %q in %s", kid, c.url)
+	}
+	return key, nil
+}
+
+// refresh downloads the key set. The caller must hold c.mu.
+func (c *jwksCache) refresh(ctx context.Context, client *http.Client) error {
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.url, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint %s returned non-OK status: %d", c.url, resp.StatusCode)
+	}
+
+	var keySet struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, jwk := range keySet.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	c.keys = keys
+	c.fetched = time.Now()
+	c.expires = c.fetched.Add(cacheMaxAge(resp.Header))
+	return nil
+}
+
+// cacheMaxAge reads max-age from a Cache-Control header.
+func cacheMaxAge(header http.Header) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(directive), "=")
+		if !ok || !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	return defaultJWKSMaxAge
+}
+
+// jwtClaims are the decoded claims of a verified token.
+type jwtClaims map[string]interface{}
+
+func (c jwtClaims) String(name string) string {
+	value, _ := c[name].(string)
+	return value
+}
+
+// Strings reads a claim holding a list of strings.
+func (c jwtClaims) Strings(name string) []string {
+	values := []string{}
+	list, _ := c[name].([]interface{})
+	for _, entry := range list {
+		if s, ok := entry.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// Bool reads a boolean claim, accepting the "true" strings some issuers send.
+func (c jwtClaims) Bool(name string) bool {
+	switch value := c[name].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+	return false
+}
+
+// jwtVerifier checks RS256-signed ID tokens against a key set, a list of
+// issuers and a set of audiences. An issuer may contain {tenantid}, which is
+// replaced by the token's tid claim for multi-tenant providers.
+type jwtVerifier struct {
+	Keys      *jwksCache
+	Issuers   []string
+	Audiences map[string]bool
+}
+
+// Verify checks the signature, issuer, audience and lifetime of token and
+// returns its claims.
+func (v *jwtVerifier) Verify(ctx context.Context, client *http.Client, token string) (jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", header.Alg)
+	}
+
+	key, err := v.Keys.key(ctx, client, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+
+	claims := jwtClaims{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token payload: %v", err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *jwtVerifier) checkClaims(claims jwtClaims) error {
+	issuerOK := false
+	for _, issuer := range v.Issuers {
+		issuer = strings.ReplaceAll(issuer, "{tenantid}", claims.String("tid"))
+		if claims.String("iss") == issuer {
+			issuerOK = true
+			break
+		}
+	}
+	if !issuerOK {
+		return fmt.Errorf("unexpected issuer %q", claims.String("iss"))
+	}
+
+	audienceOK := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audienceOK = v.Audiences[aud]
+	case []interface{}:
+		for _, entry := range aud {
+			if s, ok := entry.(string); ok && v.Audiences[s] {
+				audienceOK = true
+				break
+			}
+		}
+	}
+	if !audienceOK {
+		return fmt.Errorf("unexpected audience %v", claims["aud"])
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtClockSkew)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-jwtClockSkew)) {
+		return errors.New("token is not valid yet")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Before(time.Unix(int64(iat), 0).Add(-jwtClockSkew)) {
+		return errors.New("token is issued in the future")
+	}
+	return nil
+}
+
+// parseAudiences reads a comma-separated list of client IDs from envKey,
+// defaulting to fallback.
+func parseAudiences(envKey, fallback string) map[string]bool {
+	value := os.Getenv(envKey)
+	if value == "" {
+		value = fallback
+	}
+	audiences := map[string]bool{}
+	for _, audience := range strings.Split(value, ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			audiences[audience] = true
+		}
+	}
+	return audiences
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifyIDToken verifies req.IDToken with v and consumes its nonce. Every
+// fetcher that signs in from an ID token goes through here.
+func verifyIDToken(ctx context.Context, client *http.Client, v *jwtVerifier, provider string, req TokenRequest) (jwtClaims, error) {
+	claims, err := v.Verify(ctx, client, req.IDToken)
+	if err != nil {
+		return nil, invalidIDTokenError(provider, err)
+	}
+	if err := consumeNonce(ctx, claims, req.Nonce, req.IDToken); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// invalidIDTokenError is the error answered when an ID token fails to verify.
+func invalidIDTokenError(provider string, err error) error {
+	return &requestError{
+		Status:  http.StatusUnauthorized,
+		Code:    "invalid-id-token",
+		Message: "Failed to verify " + provider + " ID token",
+		Err:     err,
+	}
+}
@@ -0,0 +1,264 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWKS serves the public keys of a set of generated RSA keys.
+type testJWKS struct {
+	server *httptest.Server
+	hits   atomic.Int32
+	fail   atomic.Bool
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PrivateKey
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	t.Helper()
+	jwks := &testJWKS{keys: map[string]*rsa.PrivateKey{}}
+	jwks.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwks.hits.Add(1)
+		if jwks.fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		jwks.mu.Lock()
+		defer jwks.mu.Unlock()
+		keys := []map[string]string{}
+		for kid, key := range jwks.keys {
+			keys = append(keys, map[string]string{
+				"kid": kid,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(jwks.server.Close)
+	jwks.addKey(t, "key-1")
+	return jwks
+}
+
+func (j *testJWKS) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	j.mu.Lock()
+	j.keys[kid] = key
+	j.mu.Unlock()
+	return key
+}
+
+func (j *testJWKS) key(kid string) *rsa.PrivateKey {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.keys[kid]
+}
+
+// signJWT builds a token with the given header fields and claims, signed
+// with RS256 by key.
+func signJWT(t *testing.T, key *rsa.PrivateKey, header map[string]string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signingInput := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("SignPKCS1v15: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func testClaims(overrides map[string]interface{}) map[string]interface{} {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": "https://login.example.com/tenant-a/v2.0",
+		"tid": "tenant-a",
+		"aud": "client-1",
+		"sub": "user-1",
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func newTestVerifier(jwks *testJWKS) *jwtVerifier {
+	return &jwtVerifier{
+		Keys:      newJWKSCache(jwks.server.URL),
+		Issuers:   []string{"https://login.example.com/{tenantid}/v2.0"},
+		Audiences: map[string]bool{"client-1": true, "client-2": true},
+	}
+}
+
+func TestJWTVerifierVerify(t *testing.T) {
+	jwks := newTestJWKS(t)
+	otherKey := jwks.addKey(t, "unused")
+	now := time.Now()
+	rs256 := map[string]string{"alg": "RS256", "kid": "key-1"}
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		key     *rsa.PrivateKey
+		claims  map[string]interface{}
+		wantErr bool
+	}{
+		{name: "valid", claims: testClaims(nil)},
+		{name: "audience list", claims: testClaims(map[string]interface{}{"aud": []string{"other", "client-2"}})},
+		{name: "audience not allowed", claims: testClaims(map[string]interface{}{"aud": "other"}), wantErr: true},
+		{name: "audience list not allowed", claims: testClaims(map[string]interface{}{"aud": []string{"other"}}), wantErr: true},
+		{name: "missing audience", claims: testClaims(map[string]interface{}{"aud": nil}), wantErr: true},
+		{name: "issuer of another tenant", claims: testClaims(map[string]interface{}{"tid": "tenant-b"}), wantErr: true},
+		{name: "issuer templated on tid", claims: testClaims(map[string]interface{}{
+			"tid": "tenant-b",
+			"iss": "https://login.example.com/tenant-b/v2.0",
+		})},
+		{name: "unknown issuer", claims: testClaims(map[string]interface{}{"iss": "https://evil.example.com/tenant-a/v2.0"}), wantErr: true},
+		{name: "expired within skew", claims: testClaims(map[string]interface{}{"exp": now.Add(-time.Minute).Unix()})},
+		{name: "expired beyond skew", claims: testClaims(map[string]interface{}{"exp": now.Add(-3 * time.Minute).Unix()}), wantErr: true},
+		{name: "missing exp", claims: testClaims(map[string]interface{}{"exp": nil}), wantErr: true},
+		{name: "nbf within skew", claims: testClaims(map[string]interface{}{"nbf": now.Add(time.Minute).Unix()})},
+		{name: "nbf beyond skew", claims: testClaims(map[string]interface{}{"nbf": now.Add(3 * time.Minute).Unix()}), wantErr: true},
+		{name: "iat beyond skew", claims: testClaims(map[string]interface{}{"iat": now.Add(3 * time.Minute).Unix()}), wantErr: true},
+		{name: "HS256", header: map[string]string{"alg": "HS256", "kid": "key-1"}, claims: testClaims(nil), wantErr: true},
+		{name: "none", header: map[string]string{"alg": "none", "kid": "key-1"}, claims: testClaims(nil), wantErr: true},
+		{name: "signed by another key", key: otherKey, claims: testClaims(nil), wantErr: true},
+		{name: "unknown kid", header: map[string]string{"alg": "RS256", "kid": "key-9"}, claims: testClaims(nil), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, key := tt.header, tt.key
+			if header == nil {
+				header = rs256
+			}
+			if key == nil {
+				key = jwks.key("key-1")
+			}
+			token := signJWT(t, key, header, tt.claims)
+			claims, err := newTestVerifier(jwks).Verify(context.Background(), jwks.server.Client(), token)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Verify accepted the token with claims %v", claims)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if claims.String("sub") != "user-1" {
+				t.Errorf("got sub %q, want user-1", claims.String("sub"))
+			}
+		})
+	}
+}
+
+func TestJWTVerifierRejectsMalformedTokens(t *testing.T) {
+	jwks := newTestJWKS(t)
+	valid := signJWT(t, jwks.key("key-1"), map[string]string{"alg": "RS256", "kid": "key-1"}, testClaims(nil))
+	for _, token := range []string{"", "a.b", "a.b.c.d", "!.!.!", valid + "x"} {
+		if _, err := newTestVerifier(jwks).Verify(context.Background(), jwks.server.Client(), token); err == nil {
+			t.Errorf("Verify accepted %q", token)
+		}
+	}
+}
+
+func TestJWKSCacheThrottlesUnknownKidRefetch(t *testing.T) {
+	jwks := newTestJWKS(t)
+	verifier := newTestVerifier(jwks)
+	client := jwks.server.Client()
+	ctx := context.Background()
+	verify := func(kid string) error {
+		_, err := verifier.Verify(ctx, client, signJWT(t, jwks.key(kid), map[string]string{"alg": "RS256", "kid": kid}, testClaims(nil)))
+		return err
+	}
+
+	if err := verify("key-1"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	jwks.addKey(t, "key-2")
+	if err := verify("key-2"); err == nil {
+		t.Fatal("a rotated key was picked up before the refresh interval")
+	}
+	if got := jwks.hits.Load(); got != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", got)
+	}
+
+	verifier.Keys.mu.Lock()
+	verifier.Keys.fetched = time.Now().Add(-2 * minJWKSRefreshInterval)
+	verifier.Keys.mu.Unlock()
+	if err := verify("key-2"); err != nil {
+		t.Fatalf("Verify after the refresh interval: %v", err)
+	}
+	jwks.addKey(t, "key-3")
+	if err := verify("key-3"); err == nil {
+		t.Fatal("a second unknown kid triggered another refetch")
+	}
+	if got := jwks.hits.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func TestJWKSCacheKeepsKeysWhenRefreshFails(t *testing.T) {
+	jwks := newTestJWKS(t)
+	verifier := newTestVerifier(jwks)
+	client := jwks.server.Client()
+	token := signJWT(t, jwks.key("key-1"), map[string]string{"alg": "RS256", "kid": "key-1"}, testClaims(nil))
+
+	if _, err := verifier.Verify(context.Background(), client, token); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	jwks.fail.Store(true)
+	verifier.Keys.mu.Lock()
+	verifier.Keys.expires = time.Now().Add(-time.Second)
+	verifier.Keys.mu.Unlock()
+
+	if _, err := verifier.Verify(context.Background(), client, token); err != nil {
+		t.Fatalf("Verify with a stale cache and a failing JWKS endpoint: %v", err)
+	}
+	if _, err := verifier.Verify(context.Background(), client, token); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got := jwks.hits.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2 (one failed refresh, then a pause)", got)
+	}
+}
+
+func TestJWKSCacheFailsWithoutCachedKeys(t *testing.T) {
+	jwks := newTestJWKS(t)
+	jwks.fail.Store(true)
+	token := signJWT(t, jwks.key("key-1"), map[string]string{"alg": "RS256", "kid": "key-1"}, testClaims(nil))
+	if _, err := newTestVerifier(jwks).Verify(context.Background(), jwks.server.Client(), token); err == nil {
+		t.Fatal("Verify succeeded without any keys")
+	}
+}
@@ -0,0 +1,257 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NoncePolicy decides which ID-token sign-ins must be bound to a nonce.
+type NoncePolicy string
+
+const (
+	// NonceOptional checks the nonce only when the request carries one.
+	NonceOptional NoncePolicy = "optional"
+	// NonceRequired rejects ID tokens sent without a nonce. Nonces may be
+	// generated by the client.
+	NonceRequired NoncePolicy = "required"
+	// NonceSigned only accepts nonces issued by IssueNonce.
+	NonceSigned NoncePolicy = "signed"
+)
+
+// nonceConfig holds the nonce settings.
+type nonceConfig struct {
+	Policy     NoncePolicy
+	SigningKey []byte
+	TTL        time.Duration
+}
+
+var (
+	nonces     nonceConfig
+	usedNonces nonceStore
+)
+
+// nonceStore remembers consumed nonces until they expire.
+type nonceStore interface {
+	// Consume marks key as used until expires and reports whether it was
+	// still unused.
+	Consume(ctx context.Context, key string, expires time.Time) (bool, error)
+}
+
+// loadNoncePolicy reads NONCE_POLICY, NONCE_SIGNING_KEY, NONCE_TTL,
+// NONCE_STORE (memory or firestore) and NONCE_COLLECTION.
+func loadNoncePolicy(app *firebase.App) {
+	nonces = nonceConfig{
+		Policy:     NoncePolicy(strings.ToLower(strings.TrimSpace(os.Getenv("NONCE_POLICY")))),
+		SigningKey: []byte(os.Getenv("NONCE_SIGNING_KEY")),
+		TTL:        10 * time.Minute,
+	}
+	switch nonces.Policy {
+	case "":
+		nonces.Policy = NonceOptional
+	case NonceOptional, NonceRequired, NonceSigned:
+	default:
+		log.Fatalf("FATAL: NONCE_POLICY must be one of optional, required or signed, got %q", nonces.Policy)
+	}
+	if nonces.Policy == NonceSigned && len(nonces.SigningKey) == 0 {
+		log.Fatal("FATAL: NONCE_SIGNING_KEY must be set when NONCE_POLICY is signed!")
+	}
+	if ttlStr := strings.TrimSpace(os.Getenv("NONCE_TTL")); ttlStr != "" {
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("FATAL: NONCE_TTL must be a positive duration such as 10m, got %q", ttlStr)
+		}
+		nonces.TTL = ttl
+	}
+
+	switch store := strings.ToLower(strings.TrimSpace(os.Getenv("NONCE_STORE"))); store {
+	case "", "memory":
+		usedNonces = &memoryNonceStore{used: map[string]time.Time{}}
+	case "firestore":
+		client, err := app.Firestore(context.Background())
+		if err != nil {
+			log.Fatalf("error getting Firestore client: %v\n", err)
+		}
+		collection := strings.TrimSpace(os.Getenv("NONCE_COLLECTION"))
+		if collection == "" {
+			collection = "used_nonces"
+		}
+		usedNonces = &firestoreNonceStore{collection: client.Collection(collection)}
+	default:
+		log.Fatalf("FATAL: NONCE_STORE must be memory or firestore, got %q", store)
+	}
+	log.Printf("INFO: Loaded nonce policy: %s (ttl=%s, issuing=%t)", nonces.Policy, nonces.TTL, len(nonces.SigningKey) > 0)
+}
+
+// IssueNonce is the public Cloud Function entry point that hands out signed,
+// short-lived nonces. The client puts the nonce, or the hex SHA-256 of it, in
+// the provider's authorization request and sends the nonce itself along with
+// the resulting ID token.
+func IssueNonce(w http.ResponseWriter, r *http.Request) {
+	ensureSetup()
+	setCorsHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if len(nonces.SigningKey) == 0 {
+		http.Error(w, "Nonce issuance is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		writeRequestError(w, &requestError{Status: http.StatusInternalServerError, Message: "Failed to generate nonce", Err: err})
+		return
+	}
+	expires := time.Now().Add(nonces.TTL)
+	payload := base64.RawURLEncoding.EncodeToString(random) + "." + strconv.FormatInt(expires.Unix(), 10)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"nonce":      payload + "." + signNonce(payload),
+		"expires_at": expires.Unix(),
+	})
+}
+
+func signNonce(payload string) string {
+	mac := hmac.New(sha256.New, nonces.SigningKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseSignedNonce returns the expiry of a nonce issued by IssueNonce, and
+// false for nonces this server did not sign.
+func parseSignedNonce(nonce string) (time.Time, bool) {
+	if len(nonces.SigningKey) == 0 {
+		return time.Time{}, false
+	}
+	cut := strings.LastIndex(nonce, ".")
+	if cut < 0 || !hmac.Equal([]byte(signNonce(nonce[:cut])), []byte(nonce[cut+1:])) {
+		return time.Time{}, false
+	}
+	_, expiresStr, _ := strings.Cut(nonce[:cut], ".")
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(expires, 0), true
+}
+
+// consumeNonce binds an ID token to this sign-in attempt: the token's nonce
+// claim must be the request's nonce or its hex SHA-256, and each nonce is
+// accepted only once. A token with a nonce claim always needs the request's
+// nonce, whatever the policy. Tokens without one are still accepted only
+// once, keyed by the token itself.
+func consumeNonce(ctx context.Context, claims jwtClaims, nonce, idToken string) error {
+	// A nonce or token stays used for as long as the token is valid.
+	expires := time.Now().Add(nonces.TTL)
+	if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Add(jwtClockSkew).After(expires) {
+		expires = time.Unix(int64(exp), 0).Add(jwtClockSkew)
+	}
+
+	tokenNonce := claims.String("nonce")
+	if nonce == "" {
+		if tokenNonce != "" || nonces.Policy != NonceOptional {
+			return nonceRequiredError()
+		}
+		digest := sha256.Sum256([]byte("id_token:" + idToken))
+		return markUsed(ctx, hex.EncodeToString(digest[:]), expires)
+	}
+
+	digest := sha256.Sum256([]byte(nonce))
+	hashed := hex.EncodeToString(digest[:])
+	if tokenNonce != nonce && tokenNonce != hashed {
+		return invalidNonceError("token nonce does not match")
+	}
+
+	if signedExpires, ok := parseSignedNonce(nonce); ok {
+		if time.Now().After(signedExpires) {
+			return invalidNonceError("nonce is expired")
+		}
+	} else if nonces.Policy == NonceSigned {
+		return invalidNonceError("nonce was not issued by this server")
+	}
+	return markUsed(ctx, hashed, expires)
+}
+
+// markUsed records key in the nonce store and rejects keys already used.
+func markUsed(ctx context.Context, key string, expires time.Time) error {
+	unused, err := usedNonces.Consume(ctx, key, expires)
+	if err != nil {
+		return &requestError{Status: http.StatusInternalServerError, Message: "Failed to record nonce", Err: err}
+	}
+	if !unused {
+		log.Printf("Rejected ID token: nonce was already used.")
+		return &requestError{Status: http.StatusUnauthorized, Code: "nonce-already-used", Message: "This sign-in attempt was already used."}
+	}
+	return nil
+}
+
+func nonceRequiredError() error {
+	return &requestError{Status: http.StatusUnauthorized, Code: "nonce-required", Message: "A nonce is required to sign in with an ID token."}
+}
+
+func invalidNonceError(reason string) error {
+	log.Printf("Rejected ID token: %s.", reason)
+	return &requestError{Status: http.StatusUnauthorized, Code: "invalid-nonce", Message: "The ID token does not belong to this sign-in attempt."}
+}
+
+// memoryNonceStore keeps used nonces in the instance's memory. It does not see
+// nonces consumed by other instances.
+type memoryNonceStore struct {
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+func (s *memoryNonceStore) Consume(ctx context.Context, key string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for usedKey, usedExpires := range s.used {
+		if now.After(usedExpires) {
+			delete(s.used, usedKey)
+		}
+	}
+	if _, ok := s.used[key]; ok {
+		return false, nil
+	}
+	s.used[key] = expires
+	return true, nil
+}
+
+// firestoreNonceStore records used nonces as documents, so a nonce is only
+// accepted once across all instances. A Firestore TTL policy on expires_at
+// cleans them up.
+type firestoreNonceStore struct {
+	collection *firestore.CollectionRef
+}
+
+func (s *firestoreNonceStore) Consume(ctx context.Context, key string, expires time.Time) (bool, error) {
+	_, err := s.collection.Doc(key).Create(ctx, map[string]interface{}{"expires_at": expires})
+	if status.Code(err) == codes.AlreadyExists {
+		return false, nil
+	}
+	return err == nil, err
+}
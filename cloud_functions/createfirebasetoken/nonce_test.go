@@ -0,0 +1,141 @@
+package createfirebasetoken
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useNoncePolicy installs a nonce configuration and an empty in-memory store
+// for the duration of the test.
+func useNoncePolicy(t *testing.T, policy NoncePolicy, signingKey string) {
+	t.Helper()
+	previousNonces, previousStore := nonces, usedNonces
+	nonces = nonceConfig{Policy: policy, SigningKey: []byte(signingKey), TTL: 10 * time.Minute}
+	usedNonces = &memoryNonceStore{used: map[string]time.Time{}}
+	t.Cleanup(func() { nonces, usedNonces = previousNonces, previousStore })
+}
+
+// testSignedNonce builds a nonce as IssueNonce does, expiring at expires.
+func testSignedNonce(random string, expires time.Time) string {
+	payload := random + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + signNonce(payload)
+}
+
+func hexSHA256(s string) string {
+	digest := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(digest[:])
+}
+
+func nonceClaims(tokenNonce string) jwtClaims {
+	claims := jwtClaims{"exp": float64(time.Now().Add(time.Hour).Unix())}
+	if tokenNonce != "" {
+		claims["nonce"] = tokenNonce
+	}
+	return claims
+}
+
+// errorCode returns the code of a *requestError, or "" for nil.
+func errorCode(t *testing.T, err error) string {
+	t.Helper()
+	if err == nil {
+		return ""
+	}
+	var reqErr *requestError
+	if !errors.As(err, &reqErr) {
+		t.Fatalf("got %T %v, want a *requestError", err, err)
+	}
+	return reqErr.Code
+}
+
+func TestConsumeNonce(t *testing.T) {
+	const signingKey = "test-signing-key"
+	// The signed nonces in the table are signed with this key.
+	useNoncePolicy(t, NonceOptional, signingKey)
+	now := time.Now()
+
+	tests := []struct {
+		name       string
+		policy     NoncePolicy
+		tokenNonce string
+		nonce      string
+		wantCode   string
+	}{
+		{name: "raw nonce", policy: NonceOptional, tokenNonce: "n-1", nonce: "n-1"},
+		{name: "hashed nonce", policy: NonceOptional, tokenNonce: hexSHA256("n-1"), nonce: "n-1"},
+		{name: "mismatch", policy: NonceOptional, tokenNonce: "n-1", nonce: "n-2", wantCode: "invalid-nonce"},
+		{name: "hash of another nonce", policy: NonceOptional, tokenNonce: hexSHA256("n-2"), nonce: "n-1", wantCode: "invalid-nonce"},
+		{name: "request nonce without token nonce", policy: NonceOptional, nonce: "n-1", wantCode: "invalid-nonce"},
+		{name: "optional without nonces", policy: NonceOptional},
+		{name: "optional with token nonce only", policy: NonceOptional, tokenNonce: "n-1", wantCode: "nonce-required"},
+		{name: "required without nonce", policy: NonceRequired, wantCode: "nonce-required"},
+		{name: "required with client nonce", policy: NonceRequired, tokenNonce: "n-1", nonce: "n-1"},
+		{name: "signed with client nonce", policy: NonceSigned, tokenNonce: "n-1", nonce: "n-1", wantCode: "invalid-nonce"},
+		{
+			name:       "signed nonce",
+			policy:     NonceSigned,
+			tokenNonce: hexSHA256(testSignedNonce("r1", now.Add(time.Minute))),
+			nonce:      testSignedNonce("r1", now.Add(time.Minute)),
+		},
+		{
+			name:       "expired signed nonce",
+			policy:     NonceSigned,
+			tokenNonce: testSignedNonce("r2", now.Add(-time.Minute)),
+			nonce:      testSignedNonce("r2", now.Add(-time.Minute)),
+			wantCode:   "invalid-nonce",
+		},
+		{
+			name:       "tampered signed nonce",
+			policy:     NonceSigned,
+			tokenNonce: testSignedNonce("r3", now.Add(time.Minute)) + "x",
+			nonce:      testSignedNonce("r3", now.Add(time.Minute)) + "x",
+			wantCode:   "invalid-nonce",
+		},
+		{
+			name:       "signed nonce under required",
+			policy:     NonceRequired,
+			tokenNonce: testSignedNonce("r4", now.Add(time.Minute)),
+			nonce:      testSignedNonce("r4", now.Add(time.Minute)),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useNoncePolicy(t, tt.policy, signingKey)
+			err := consumeNonce(context.Background(), nonceClaims(tt.tokenNonce), tt.nonce, "token-"+tt.name)
+			if got := errorCode(t, err); got != tt.wantCode {
+				t.Fatalf("got error %v, want code %q", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestConsumeNonceIsSingleUse(t *testing.T) {
+	useNoncePolicy(t, NonceOptional, "")
+	ctx := context.Background()
+
+	if err := consumeNonce(ctx, nonceClaims("n-1"), "n-1", "token-1"); err != nil {
+		t.Fatalf("consumeNonce: %v", err)
+	}
+	// The same nonce in another token, hashed or not, is rejected.
+	for _, tokenNonce := range []string{"n-1", hexSHA256("n-1")} {
+		err := consumeNonce(ctx, nonceClaims(tokenNonce), "n-1", "token-2")
+		if got := errorCode(t, err); got != "nonce-already-used" {
+			t.Errorf("reusing the nonce with token nonce %q: got %v, want nonce-already-used", tokenNonce, err)
+		}
+	}
+
+	// Tokens without a nonce can only be used once as well.
+	if err := consumeNonce(ctx, nonceClaims(""), "", "token-3"); err != nil {
+		t.Fatalf("consumeNonce: %v", err)
+	}
+	if got := errorCode(t, consumeNonce(ctx, nonceClaims(""), "", "token-3")); got != "nonce-already-used" {
+		t.Errorf("replaying a token without nonce: got code %q, want nonce-already-used", got)
+	}
+	if err := consumeNonce(ctx, nonceClaims(""), "", "token-4"); err != nil {
+		t.Errorf("another token without nonce: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package createfirebasetoken
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// ProfileSyncMode controls when a profile field is copied from the provider
+// onto the Firebase user record.
+type ProfileSyncMode string
+
+const (
+	// ProfileSyncNever never writes the field.
+	ProfileSyncNever ProfileSyncMode = "never"
+	// ProfileSyncOnCreate writes the field only when the user is created.
+	ProfileSyncOnCreate ProfileSyncMode = "on_create"
+	// ProfileSyncAlways writes the field on creation and on every sign-in.
+	ProfileSyncAlways ProfileSyncMode = "always"
+	// ProfileSyncBackfill is only valid for the email. It writes it when the
+	// user is created, and on sign-in writes a verified email onto users that
+	// have none or have the same address unverified, e.g. GitHub users whose
+	// primary email only became readable through /user/emails.
+	ProfileSyncBackfill ProfileSyncMode = "backfill"
+)
+
+// Names of the profile fields reported back to the client when they change.
+const (
+	fieldDisplayName = "display_name"
+	fieldPhotoURL    = "photo_url"
+	fieldEmail       = "email"
+)
+
+// ProfileSyncPolicy holds the sync mode of every profile field.
+type ProfileSyncPolicy struct {
+	DisplayName ProfileSyncMode
+	PhotoURL    ProfileSyncMode
+	Email       ProfileSyncMode
+}
+
+var profileSyncPolicy ProfileSyncPolicy
+
+// loadProfileSyncPolicy reads PROFILE_SYNC_MODE as the default for all fields
+// and lets PROFILE_SYNC_DISPLAY_NAME, PROFILE_SYNC_PHOTO_URL and
+// PROFILE_SYNC_EMAIL override it per field. Email defaults to backfill since
+// replacing it on a returning user can collide with another account.
+func loadProfileSyncPolicy() {
+	defaultMode := parseProfileSyncMode("PROFILE_SYNC_MODE", ProfileSyncAlways, false)
+	emailDefault := defaultMode
+	if os.Getenv("PROFILE_SYNC_MODE") == "" {
+		emailDefault = ProfileSyncBackfill
+	}
+	profileSyncPolicy = ProfileSyncPolicy{
+		DisplayName: parseProfileSyncMode("PROFILE_SYNC_DISPLAY_NAME", defaultMode, false),
+		PhotoURL:    parseProfileSyncMode("PROFILE_SYNC_PHOTO_URL", defaultMode, false),
+		Email:       parseProfileSyncMode("PROFILE_SYNC_EMAIL", emailDefault, true),
+	}
+	log.Printf("INFO: Loaded profile sync policy: %+v", profileSyncPolicy)
+}
+
+func parseProfileSyncMode(envKey string, fallback ProfileSyncMode, allowBackfill bool) ProfileSyncMode {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(envKey)))
+	switch ProfileSyncMode(value) {
+	case "":
+		return fallback
+	case ProfileSyncNever, ProfileSyncOnCreate, ProfileSyncAlways:
+		return ProfileSyncMode(value)
+	case ProfileSyncBackfill:
+		if allowBackfill {
+			return ProfileSyncBackfill
+		}
+		log.Fatalf("FATAL: %s does not support backfill, which is only valid for PROFILE_SYNC_EMAIL", envKey)
+		return fallback
+	default:
+		log.Fatalf("FATAL: %s must be one of never, on_create or always, got %q", envKey, value)
+		return fallback
+	}
+}
+
+// writesOnCreate reports whether the field should be set on a new user.
+func (m ProfileSyncMode) writesOnCreate() bool {
+	return m == ProfileSyncOnCreate || m == ProfileSyncAlways || m == ProfileSyncBackfill
+}
+
+// writesOnSignIn reports whether the field should be refreshed on a
+// returning user.
+func (m ProfileSyncMode) writesOnSignIn() bool {
+	return m == ProfileSyncAlways
+}
@@ -0,0 +1,215 @@
+package createfirebasetoken
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// AuthCodeRequest is the JSON body accepted by SignInWithAuthCode.
+type AuthCodeRequest struct {
+	Code         string `json:"code"`
+	RedirectURI  string `json:"redirect_uri"`
+	ClientID     string `json:"client_id,omitempty"`
+	CodeVerifier string `json:"code_verifier,omitempty"`
+	// Nonce is the nonce sent in the authorization request, checked against
+	// the ID token when the provider returns one.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// codeExchange describes how a provider's authorization code is redeemed.
+// Customize adjusts the request the same way ExchangeAuthCode does.
+type codeExchange struct {
+	TokenURL  string
+	Customize func(req *http.Request, data url.Values, clientID, clientSecret string)
+}
+
+type providerSecrets struct {
+	ID     string
+	Secret string
+}
+
+var (
+	codeExchanges  map[string]codeExchange
+	secretsFromEnv map[string]providerSecrets
+)
+
+// loadCodeExchanges reads the same OAUTH_CLIENT_ID_* and OAUTH_CLIENT_SECRET_*
+// variables as ExchangeAuthCode. Providers without a secret cannot be used with
+// SignInWithAuthCode.
+func loadCodeExchanges() {
+	secretsFromEnv = map[string]providerSecrets{}
+	loadSecretsForProvider("facebook", "OAUTH_CLIENT_ID_FACEBOOK", "OAUTH_CLIENT_SECRET_FACEBOOK")
+	loadSecretsForProvider("github", "OAUTH_CLIENT_ID_GITHUB", "OAUTH_CLIENT_SECRET_GITHUB")
+	loadSecretsForProvider("google", "OAUTH_CLIENT_ID_GOOGLE", "OAUTH_CLIENT_SECRET_GOOGLE")
+	loadSecretsForProvider("instagram", "OAUTH_CLIENT_ID_INSTAGRAM", "OAUTH_CLIENT_SECRET_INSTAGRAM")
+	loadSecretsForProvider("linkedin", "OAUTH_CLIENT_ID_LINKEDIN", "OAUTH_CLIENT_SECRET_LINKEDIN")
+	loadSecretsForProvider("microsoft", "OAUTH_CLIENT_ID_MICROSOFT", "OAUTH_CLIENT_SECRET_MICROSOFT")
+	loadSecretsForProvider("tiktok", "OAUTH_CLIENT_ID_TIKTOK", "OAUTH_CLIENT_SECRET_TIKTOK")
+	loadSecretsForProvider("x_twitter", "OAUTH_CLIENT_ID_X_TWITTER", "OAUTH_CLIENT_SECRET_X_TWITTER")
+
+	acceptJSON := func(req *http.Request, data url.Values, clientID, clientSecret string) {
+		req.Header.Set("Accept", "application/json")
+	}
+	basicAuth := func(req *http.Request, data url.Values, clientID, clientSecret string) {
+		req.SetBasicAuth(clientID, clientSecret)
+		data.Del("client_id")
+		data.Del("client_secret")
+	}
+	microsoftTenant := os.Getenv("MICROSOFT_TENANT_ID")
+	if microsoftTenant == "" {
+		microsoftTenant = "common"
+	}
+
+	codeExchanges = map[string]codeExchange{
+		"google":    {TokenURL: "https://oauth2.googleapis.com/token", Customize: acceptJSON},
+		"facebook":  {TokenURL: "https://graph.facebook.com/v19.0/oauth/access_token"},
+		"instagram": {TokenURL: "https://api.instagram.com/oauth/access_token"},
+		"linkedin":  {TokenURL: "https://www.linkedin.com/oauth/v2/accessToken"},
+		"github":    {TokenURL: "https://github.com/login/oauth/access_token", Customize: acceptJSON},
+		"tiktok": {
+			TokenURL: "https://open.tiktokapis.com/v2/oauth/token/",
+			Customize: func(req *http.Request, data url.Values, clientID, clientSecret string) {
+				data.Set("client_key", data.Get("client_id"))
+				data.Del("client_id")
+			},
+		},
+		"x_twitter": {TokenURL: "https://api.twitter.com/2/oauth2/token", Customize: basicAuth},
+		"microsoft": {
+			TokenURL: fmt.Sprintf("https://login.microsoftonline.com/%s/oauth2/v2.0/token", microsoftTenant),
+			Customize: func(req *http.Request, data url.Values, clientID, clientSecret string) {
+				basicAuth(req, data, clientID, clientSecret)
+				data.Set("scope", "openid profile email")
+			},
+		},
+	}
+}
+
+func loadSecretsForProvider(providerKey, idEnvKey, secretEnvKey string) {
+	secretsFromEnv[providerKey] = providerSecrets{
+		ID:     os.Getenv(idEnvKey),
+		Secret: os.Getenv(secretEnvKey),
+	}
+}
+
+// SignInWithAuthCode is the public Cloud Function entry point for the one-shot
+// flow. It redeems an authorization code (and PKCE verifier) with the provider
+// routed on the URL path, fetches the user's profile and answers with the
+// Firebase custom token only, so provider tokens never reach the device.
+func SignInWithAuthCode(w http.ResponseWriter, r *http.Request) {
+	ensureSetup()
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	fetcher, ok := userInfoFetchers[path]
+	exchange, hasExchange := codeExchanges[path]
+	if !ok || !hasExchange {
+		http.NotFound(w, r)
+		return
+	}
+
+	setCorsHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody AuthCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	client := &http.Client{}
+	tokenReq, err := exchangeAuthCode(r, client, path, exchange, reqBody)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	profile, err := fetcher.FetchProfile(r.Context(), client, tokenReq)
+	if err != nil {
+		writeRequestError(w, err)
+		return
+	}
+
+	signInWithProfile(w, profile)
+}
+
+// exchangeAuthCode redeems the authorization code with the provider's token
+// endpoint and returns the resulting tokens as a TokenRequest. Providers that
+// return an id_token are then signed in from its verified claims.
+func exchangeAuthCode(r *http.Request, client *http.Client, provider string, exchange codeExchange, reqBody AuthCodeRequest) (TokenRequest, error) {
+	secrets := secretsFromEnv[provider]
+	clientID := reqBody.ClientID
+	if clientID == "" {
+		clientID = secrets.ID
+	}
+
+	switch {
+	case reqBody.Code == "":
+		return TokenRequest{}, &requestError{Status: http.StatusBadRequest, Message: "Missing required parameter: code"}
+	case reqBody.RedirectURI == "":
+		return TokenRequest{}, &requestError{Status: http.StatusBadRequest, Message: "Missing required parameter: redirect_uri"}
+	case clientID == "":
+		return TokenRequest{}, &requestError{Status: http.StatusBadRequest, Message: "Missing required parameter: client_id"}
+	case secrets.Secret == "":
+		return TokenRequest{}, &requestError{Status: http.StatusBadRequest, Message: "Missing required parameter: client_secret"}
+	}
+
+	data := url.Values{}
+	data.Set("code", reqBody.Code)
+	data.Set("redirect_uri", reqBody.RedirectURI)
+	data.Set("grant_type", "authorization_code")
+	data.Set("client_id", clientID)
+	data.Set("client_secret", secrets.Secret)
+	if reqBody.CodeVerifier != "" {
+		data.Set("code_verifier", reqBody.CodeVerifier)
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST", exchange.TokenURL, nil)
+	if err != nil {
+		return TokenRequest{}, &requestError{Status: http.StatusInternalServerError, Message: "Failed to create request", Err: err}
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if exchange.Customize != nil {
+		exchange.Customize(req, data, clientID, secrets.Secret)
+	}
+	req.Body = io.NopCloser(strings.NewReader(data.Encode()))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return TokenRequest{}, &requestError{Status: http.StatusBadGateway, Message: "Failed to contact token endpoint", Err: err}
+	}
+	defer resp.Body.Close()
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+		IDToken     string `json:"id_token"`
+		// Instagram Login may wrap the token in a data array.
+		Data []struct {
+			AccessToken string `json:"access_token"`
+		} `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if tokenResp.AccessToken == "" && len(tokenResp.Data) > 0 {
+		tokenResp.AccessToken = tokenResp.Data[0].AccessToken
+	}
+	if err != nil || resp.StatusCode != http.StatusOK || tokenResp.AccessToken == "" {
+		log.Printf("Code exchange with %s failed with status %d", provider, resp.StatusCode)
+		return TokenRequest{}, &requestError{Status: http.StatusUnauthorized, Message: "Failed to exchange authorization code"}
+	}
+	return TokenRequest{
+		AccessToken:      tokenResp.AccessToken,
+		IDToken:          tokenResp.IDToken,
+		Nonce:            reqBody.Nonce,
+		AudienceVerified: true,
+	}, nil
+}
@@ -0,0 +1,177 @@
+package createfirebasetoken
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Providers whose access tokens cannot be tied to our client ID. Anyone who
+// runs their own app with one of these providers can replay its users' tokens
+// against CreateFirebaseToken and sign in as them, so they have to be enabled
+// explicitly through ALLOW_UNVERIFIED_AUDIENCE_PROVIDERS. SignInWithAuthCode is
+// not affected since it only uses tokens from its own code exchange.
+var providersWithoutAudienceCheck = map[string]bool{
+	"instagram": true,
+	"linkedin":  true,
+	"microsoft": true,
+	"tiktok":    true,
+	"x_twitter": true,
+}
+
+// Providers whose fetchers verify an idToken, including its audience.
+var providersWithIDTokens = map[string]bool{
+	"google":    true,
+	"linkedin":  true,
+	"microsoft": true,
+}
+
+var (
+	unverifiedAudienceProviders map[string]bool
+	googleAllowedAudiences      map[string]bool
+)
+
+// loadAudiencePolicy reads ALLOW_UNVERIFIED_AUDIENCE_PROVIDERS and the
+// GOOGLE_, MICROSOFT_, LINKEDIN_ and FACEBOOK_ALLOWED_AUDIENCES lists of client
+// IDs accepted in ID tokens, which default to the provider's OAUTH_CLIENT_ID_*.
+// GOOGLE_ALLOWED_AUDIENCES also applies to Google access tokens. It must run
+// after loadCodeExchanges.
+func loadAudiencePolicy() {
+	unverifiedAudienceProviders = parseLowerSet(os.Getenv("ALLOW_UNVERIFIED_AUDIENCE_PROVIDERS"))
+	for provider := range unverifiedAudienceProviders {
+		if providersWithoutAudienceCheck[provider] {
+			log.Printf("WARNING: %s tokens are accepted without an audience check.", provider)
+		}
+	}
+
+	googleAllowedAudiences = parseAudiences("GOOGLE_ALLOWED_AUDIENCES", secretsFromEnv["google"].ID)
+	googleIDTokens.Audiences = googleAllowedAudiences
+	microsoftIDTokens.Audiences = parseAudiences("MICROSOFT_ALLOWED_AUDIENCES", secretsFromEnv["microsoft"].ID)
+	linkedInIDTokens.Audiences = parseAudiences("LINKEDIN_ALLOWED_AUDIENCES", secretsFromEnv["linkedin"].ID)
+	facebookLimitedLoginTokens.Audiences = parseAudiences("FACEBOOK_ALLOWED_AUDIENCES", secretsFromEnv["facebook"].ID)
+}
+
+// checkAudienceCheckAvailable rejects providers whose tokens cannot be
+// audience-checked unless they were opted in. ID tokens carry their own
+// audience, so requests with one are always allowed.
+func checkAudienceCheckAvailable(provider string, req TokenRequest) error {
+	if !providersWithoutAudienceCheck[provider] || unverifiedAudienceProviders[provider] {
+		return nil
+	}
+	if req.IDToken != "" && providersWithIDTokens[provider] {
+		return nil
+	}
+	log.Printf("Rejected %s token: provider has no audience check and is not opted in.", provider)
+	return &requestError{
+		Status:  http.StatusForbidden,
+		Code:    "provider-not-enabled",
+		Message: "This provider must be used through SignInWithAuthCode.",
+	}
+}
+
+func audienceMismatchError(provider string) error {
+	log.Printf("Rejected %s token: issued for another client ID.", provider)
+	return &requestError{
+		Status:  http.StatusUnauthorized,
+		Code:    "token-audience-mismatch",
+		Message: "The access token was not issued for this app.",
+	}
+}
+
+func audienceNotConfiguredError(provider string) error {
+	return &requestError{
+		Status:  http.StatusInternalServerError,
+		Message: "Token audience check is not configured for " + provider,
+	}
+}
+
+// verifyFacebookAudience asks debug_token whether accessToken is a valid token
+// of our app for userID.
+func verifyFacebookAudience(ctx context.Context, client *http.Client, accessToken, userID string) error {
+	secrets := secretsFromEnv["facebook"]
+	if secrets.ID == "" || secrets.Secret == "" {
+		return audienceNotConfiguredError("facebook")
+	}
+
+	query := url.Values{}
+	query.Set("input_token", accessToken)
+	req := newFacebookGraphRequest(ctx, "/debug_token", query, secrets.ID+"|"+secrets.Secret)
+
+	var debugResp struct {
+		Data struct {
+			AppID   string `json:"app_id"`
+			UserID  string `json:"user_id"`
+			IsValid bool   `json:"is_valid"`
+		} `json:"data"`
+	}
+	if _, err := fetchUserInfo(req, client, "Facebook", &debugResp); err != nil {
+		return err
+	}
+	if !debugResp.Data.IsValid || debugResp.Data.AppID != secrets.ID || debugResp.Data.UserID != userID {
+		return audienceMismatchError("facebook")
+	}
+	return nil
+}
+
+// verifyGoogleAudience checks the aud and azp that tokeninfo reports for
+// accessToken against the allowed client IDs. The token is posted as a form
+// so it does not end up in URLs and request logs.
+func verifyGoogleAudience(ctx context.Context, client *http.Client, accessToken, userID string) error {
+	if len(googleAllowedAudiences) == 0 {
+		return audienceNotConfiguredError("google")
+	}
+
+	form := url.Values{}
+	form.Set("access_token", accessToken)
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://oauth2.googleapis.com/tokeninfo", strings.NewReader(form.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	var tokenInfo struct {
+		Aud string `json:"aud"`
+		Azp string `json:"azp"`
+		Sub string `json:"sub"`
+	}
+	if _, err := fetchUserInfo(req, client, "Google", &tokenInfo); err != nil {
+		return err
+	}
+	if !(googleAllowedAudiences[tokenInfo.Aud] || googleAllowedAudiences[tokenInfo.Azp]) || tokenInfo.Sub != userID {
+		return audienceMismatchError("google")
+	}
+	return nil
+}
+
+// verifyGitHubAudience uses GitHub's check-a-token endpoint, which only
+// succeeds for tokens issued to our OAuth app.
+func verifyGitHubAudience(ctx context.Context, client *http.Client, accessToken string) error {
+	secrets := secretsFromEnv["github"]
+	if secrets.ID == "" || secrets.Secret == "" {
+		return audienceNotConfiguredError("github")
+	}
+
+	body, _ := json.Marshal(map[string]string{"access_token": accessToken})
+	req, _ := http.NewRequestWithContext(ctx, "POST", "https://api.github.com/applications/"+url.PathEscape(secrets.ID)+"/token", bytes.NewReader(body))
+	req.SetBasicAuth(secrets.ID, secrets.Secret)
+	req.Header.Add("Accept", "application/vnd.github+json")
+	req.Header.Add("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return &requestError{Status: http.StatusInternalServerError, Message: "Failed to contact GitHub API", Err: err}
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound, http.StatusUnprocessableEntity:
+		return audienceMismatchError("github")
+	default:
+		log.Printf("GitHub token check returned non-OK status: %d", resp.StatusCode)
+		return &requestError{Status: http.StatusUnauthorized, Message: "Failed to verify GitHub token"}
+	}
+}
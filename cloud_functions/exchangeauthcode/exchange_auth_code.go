@@ -40,7 +40,7 @@ func init() {
 	loadSecretsForProvider("linkedin", "OAUTH_CLIENT_ID_LINKEDIN", "OAUTH_CLIENT_SECRET_LINKEDIN")
 	loadSecretsForProvider("microsoft", "OAUTH_CLIENT_ID_MICROSOFT", "OAUTH_CLIENT_SECRET_MICROSOFT")
 	loadSecretsForProvider("tiktok", "OAUTH_CLIENT_ID_TIKTOK", "OAUTH_CLIENT_SECRET_TIKTOK")
-	loadSecretsForProvider("x", "OAUTH_CLIENT_ID_X_TWITTER", "OAUTH_CLIENT_SECRET_X_TWITTER")
+	loadSecretsForProvider("x_twitter", "OAUTH_CLIENT_ID_X_TWITTER", "OAUTH_CLIENT_SECRET_X_TWITTER")
 }
 
 func loadSecretsForProvider(providerKey, idEnvKey, secretEnvKey string) {
@@ -70,6 +70,33 @@ func ExchangeAuthCode(w http.ResponseWriter, r *http.Request) {
 		tokenURL := "https://api.instagram.com/oauth/access_token"
 		exchangeCode(w, r, path, tokenURL, nil)
 		return
+	case "facebook/long_lived":
+		tokenURL := "https://graph.facebook.com/v19.0/oauth/access_token"
+		customizer := func(query url.Values, accessToken string, envSecrets providerSecrets) {
+			query.Set("grant_type", "fb_exchange_token")
+			query.Set("client_id", envSecrets.ID)
+			query.Set("client_secret", envSecrets.Secret)
+			query.Set("fb_exchange_token", accessToken)
+		}
+		exchangeLongLivedToken(w, r, "facebook", http.MethodPost, tokenURL, true, customizer)
+		return
+	case "instagram/long_lived":
+		tokenURL := "https://graph.instagram.com/access_token"
+		customizer := func(query url.Values, accessToken string, envSecrets providerSecrets) {
+			query.Set("grant_type", "ig_exchange_token")
+			query.Set("client_secret", envSecrets.Secret)
+			query.Set("access_token", accessToken)
+		}
+		exchangeLongLivedToken(w, r, "instagram", http.MethodGet, tokenURL, true, customizer)
+		return
+	case "instagram/refresh":
+		tokenURL := "https://graph.instagram.com/refresh_access_token"
+		customizer := func(query url.Values, accessToken string, envSecrets providerSecrets) {
+			query.Set("grant_type", "ig_refresh_token")
+			query.Set("access_token", accessToken)
+		}
+		exchangeLongLivedToken(w, r, "instagram", http.MethodGet, tokenURL, false, customizer)
+		return
 	case "linkedin":
 		tokenURL := "https://www.linkedin.com/oauth/v2/accessToken"
 		exchangeCode(w, r, path, tokenURL, nil)
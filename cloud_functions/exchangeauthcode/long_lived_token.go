@@ -0,0 +1,91 @@
+package exchangeauthcode
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type LongLivedTokenInput struct {
+	AccessToken *string `json:"access_token,omitempty"`
+}
+
+// exchangeLongLivedToken trades the access_token in the request body for a
+// long-lived one (or refreshes a long-lived one) at tokenURL. The customizer
+// adds the grant parameters, which are POSTed as a form, or sent in the query
+// for endpoints that only accept GET; the app secret never leaves the server.
+// The provider's response is passed through like in exchangeCode.
+func exchangeLongLivedToken(w http.ResponseWriter, r *http.Request, provider, method, tokenURL string, needsSecret bool, customizer func(url.Values, string, providerSecrets)) {
+	setCorsHeaders(w, r)
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var reqBody LongLivedTokenInput
+	if err := json.NewDecoder(r.Body).Decode(&reqBody); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if reqBody.AccessToken == nil || *reqBody.AccessToken == "" {
+		http.Error(w, "Missing required parameter: access_token", http.StatusBadRequest)
+		return
+	}
+
+	envSecrets := secretsFromEnv[provider]
+	if needsSecret && envSecrets.Secret == "" {
+		http.Error(w, "Missing required parameter: client_secret", http.StatusBadRequest)
+		return
+	}
+
+	params := url.Values{}
+	customizer(params, *reqBody.AccessToken, envSecrets)
+
+	var req *http.Request
+	var err error
+	if method == http.MethodPost {
+		req, err = http.NewRequestWithContext(r.Context(), method, tokenURL, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequestWithContext(r.Context(), method, tokenURL+"?"+params.Encode(), nil)
+	}
+	if err != nil {
+		log.Printf("Failed to create %s token request: %v", provider, err)
+		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		return
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The URL may carry the secret and the user's token, so only the
+		// underlying error is logged and none of it is returned.
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		log.Printf("Failed to contact %s token endpoint: %v", provider, err)
+		http.Error(w, "Failed to contact token endpoint", http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, "Failed to read response", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	w.Write(body)
+}
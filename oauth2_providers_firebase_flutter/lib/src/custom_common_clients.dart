@@ -26,6 +26,7 @@ final class CustomGoogleAuthClient extends CustomTokenClient {
     required super.callbackUrlScheme,
     super.clientSecret,
     required this.customTokenEndpoint,
+    super.authCodeSignInEndpoint,
   });
 
   @override
@@ -45,6 +46,10 @@ final class CustomGitHubAuthClient extends CustomTokenClient {
   @override
   final Uri customTokenEndpoint;
 
+  /// Requests the read:org scope, which the backend needs when
+  /// GITHUB_ALLOWED_ORGS or GITHUB_ROLE_TEAMS is set.
+  final bool requestOrgAccess;
+
   const CustomGitHubAuthClient({
     required super.backendUrl,
     required super.clientId,
@@ -52,6 +57,8 @@ final class CustomGitHubAuthClient extends CustomTokenClient {
     required super.callbackUrlScheme,
     super.clientSecret,
     required this.customTokenEndpoint,
+    super.authCodeSignInEndpoint,
+    this.requestOrgAccess = false,
   });
 
   @override
@@ -59,7 +66,11 @@ final class CustomGitHubAuthClient extends CustomTokenClient {
     return Uri.https('github.com', '/login/oauth/authorize', {
       'client_id': clientId,
       'redirect_uri': createRedirectUrl().toString(),
-      'scope': 'read:user user:email',
+      'scope': [
+        'read:user',
+        'user:email',
+        if (requestOrgAccess) 'read:org',
+      ].join(' '),
       'state': state,
     });
   }
@@ -77,6 +88,7 @@ final class CustomFacebookAuthClient extends CustomTokenClient {
     required super.callbackUrlScheme,
     super.clientSecret,
     required this.customTokenEndpoint,
+    super.authCodeSignInEndpoint,
   });
 
   @override
@@ -103,6 +115,7 @@ final class CustomMicrosoftAuthClient extends CustomTokenClient {
     required super.callbackUrlScheme,
     super.clientSecret,
     required this.customTokenEndpoint,
+    super.authCodeSignInEndpoint,
   });
 
   @override
@@ -123,6 +136,10 @@ final class CustomXTwitterAuthClient extends CustomTokenClient {
   @override
   final Uri customTokenEndpoint;
 
+  /// Requests the users.email scope, so the backend can read the user's
+  /// confirmed email when X_REQUEST_CONFIRMED_EMAIL is set.
+  final bool requestEmail;
+
   const CustomXTwitterAuthClient({
     required super.backendUrl,
     required super.clientId,
@@ -130,6 +147,8 @@ final class CustomXTwitterAuthClient extends CustomTokenClient {
     required super.callbackUrlScheme,
     super.clientSecret,
     required this.customTokenEndpoint,
+    super.authCodeSignInEndpoint,
+    this.requestEmail = false,
   }) : super(usePkce: true);
 
   @override
@@ -138,7 +157,12 @@ final class CustomXTwitterAuthClient extends CustomTokenClient {
       'response_type': 'code',
       'client_id': clientId,
       'redirect_uri': createRedirectUrl().toString(),
-      'scope': 'tweet.read users.read offline.access',
+      'scope': [
+        'tweet.read',
+        'users.read',
+        if (requestEmail) 'users.email',
+        'offline.access',
+      ].join(' '),
       'state': state,
       'code_challenge': codeChallenge!,
       'code_challenge_method': 'S256',
@@ -158,6 +182,7 @@ final class CustomLinkedInAuthClient extends CustomTokenClient {
     required super.callbackUrlScheme,
     super.clientSecret,
     required this.customTokenEndpoint,
+    super.authCodeSignInEndpoint,
   });
 
   @override
@@ -177,6 +202,10 @@ final class CustomTikTokAuthClient extends CustomTokenClient {
   @override
   final Uri customTokenEndpoint;
 
+  /// Requests the user.info.profile scope, which the backend needs when
+  /// TIKTOK_PROFILE_FIELDS is set.
+  final bool requestProfile;
+
   const CustomTikTokAuthClient({
     required super.backendUrl,
     required super.clientId,
@@ -184,13 +213,18 @@ final class CustomTikTokAuthClient extends CustomTokenClient {
     required super.callbackUrlScheme,
     super.clientSecret,
     required this.customTokenEndpoint,
+    super.authCodeSignInEndpoint,
+    this.requestProfile = false,
   });
 
   @override
   Uri buildAuthUrl({required String state, String? codeChallenge}) {
     return Uri.https('www.tiktok.com', '/v2/auth/authorize/', {
       'client_key': clientId,
-      'scope': 'user.info.basic',
+      'scope': [
+        'user.info.basic',
+        if (requestProfile) 'user.info.profile',
+      ].join(','),
       'response_type': 'code',
       'redirect_uri': createRedirectUrl().toString(),
       'state': state,
@@ -198,11 +232,16 @@ final class CustomTikTokAuthClient extends CustomTokenClient {
   }
 }
 
-/// Implements the custom token sign-in flow for Instagram.
+/// Implements the custom token sign-in flow for Instagram, using the
+/// Instagram API with Instagram Login.
 final class CustomInstagramAuthClient extends CustomTokenClient {
   @override
   final Uri customTokenEndpoint;
 
+  /// Uses the retired Basic Display flow instead, for apps whose backend
+  /// still sets INSTAGRAM_BASIC_DISPLAY.
+  final bool useBasicDisplay;
+
   const CustomInstagramAuthClient({
     required super.backendUrl,
     required super.clientId,
@@ -210,16 +249,38 @@ final class CustomInstagramAuthClient extends CustomTokenClient {
     required super.callbackUrlScheme,
     super.clientSecret,
     required this.customTokenEndpoint,
+    super.authCodeSignInEndpoint,
+    this.useBasicDisplay = false,
   });
 
   @override
   Uri buildAuthUrl({required String state, String? codeChallenge}) {
-    return Uri.https('api.instagram.com', '/oauth/authorize', {
+    if (useBasicDisplay) {
+      return Uri.https('api.instagram.com', '/oauth/authorize', {
+        'client_id': clientId,
+        'redirect_uri': createRedirectUrl().toString(),
+        'scope': 'user_profile,user_media',
+        'response_type': 'code',
+        'state': state,
+      });
+    }
+    return Uri.https('www.instagram.com', '/oauth/authorize', {
       'client_id': clientId,
       'redirect_uri': createRedirectUrl().toString(),
-      'scope': 'user_profile,user_media',
+      'scope': 'instagram_business_basic',
       'response_type': 'code',
       'state': state,
     });
   }
+
+  /// The Instagram API with Instagram Login may wrap its token response as
+  /// `{"data": [{"access_token": ...}]}`.
+  @override
+  String? accessTokenFrom(Map<String, dynamic> tokenData) {
+    final data = tokenData['data'];
+    if (data is List && data.isNotEmpty && data.first is Map) {
+      return (data.first as Map)['access_token'] as String?;
+    }
+    return super.accessTokenFrom(tokenData);
+  }
 }
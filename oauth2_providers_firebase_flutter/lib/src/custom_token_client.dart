@@ -27,11 +27,17 @@ abstract base class CustomTokenClient extends OAuth2Client {
     required super.callbackUrlScheme,
     super.clientSecret,
     super.usePkce,
+    this.authCodeSignInEndpoint,
   });
 
   /// The backend endpoint for creating a Firebase custom token.
   Uri get customTokenEndpoint;
 
+  /// The optional backend endpoint that exchanges the authorization code and
+  /// creates the Firebase custom token in one round trip (`SignInWithAuthCode`).
+  /// When set, the provider's access token never reaches the device.
+  final Uri? authCodeSignInEndpoint;
+
   /// Throws an error as this flow does not create a standard `OAuthCredential`.
   @override
   AuthCredential createFirebaseCredential(Map<String, dynamic> tokenData) {
@@ -44,22 +50,59 @@ abstract base class CustomTokenClient extends OAuth2Client {
     // Step 1: Get the OAuth authorization code from the provider.
     final authCodeData = await getAuthorizationCode();
 
+    // One-shot flow: the backend exchanges the code and mints the token.
+    if (authCodeSignInEndpoint != null) {
+      final body = <String, dynamic>{
+        'code': authCodeData.code,
+        'redirect_uri': createRedirectUrl().toString(),
+        'client_id': clientId,
+      };
+      if (authCodeData.codeVerifier != null) {
+        body['code_verifier'] = authCodeData.codeVerifier;
+      }
+      final response = await http.post(
+        authCodeSignInEndpoint!,
+        headers: {'Content-Type': 'application/json'},
+        body: jsonEncode(body),
+      );
+      await _signInWithTokenResponse(response);
+      return;
+    }
+
     // Step 2: Exchange the code for the provider's access token.
     final tokenData = await getTokenData(
       code: authCodeData.code,
       codeVerifier: authCodeData.codeVerifier,
     );
-    final accessToken = tokenData['access_token'] as String?;
+    final accessToken = accessTokenFrom(tokenData);
     if (accessToken == null) {
       throw Exception('Provider did not return an access token.');
     }
 
-    // Step 3: Send the access token to a backend function to mint a Firebase token.
+    // Step 3: Send the tokens to a backend function to mint a Firebase token.
+    // Providers such as Microsoft identify the user from the verified ID token.
+    final body = <String, dynamic>{'accessToken': accessToken};
+    final idToken = tokenData['id_token'] as String?;
+    if (idToken != null) {
+      body['idToken'] = idToken;
+    }
     final response = await http.post(
       customTokenEndpoint,
       headers: {'Content-Type': 'application/json'},
-      body: jsonEncode({'accessToken': accessToken}),
+      body: jsonEncode(body),
     );
+
+    // Step 4: Sign in to Firebase using the fetched custom token.
+    await _signInWithTokenResponse(response);
+  }
+
+  /// Reads the access token from the provider's token response.
+  String? accessTokenFrom(Map<String, dynamic> tokenData) {
+    return tokenData['access_token'] as String?;
+  }
+
+  /// Signs in to Firebase with the custom token in a backend [response].
+  Future<void> _signInWithTokenResponse(http.Response response) async {
     if (response.statusCode != 200) {
       throw Exception(
         'Backend failed to create custom token. Status: ${response.statusCode}, Body: ${response.body}',
@@ -70,8 +113,6 @@ abstract base class CustomTokenClient extends OAuth2Client {
     if (firebaseToken == null) {
       throw Exception('Backend response did not include a firebase_token.');
     }
-
-    // Step 4: Sign in to Firebase using the fetched custom token.
     await FirebaseAuth.instance.signInWithCustomToken(firebaseToken);
   }
 }